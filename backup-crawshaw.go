@@ -0,0 +1,36 @@
+//go:build !zombiezen_sqlite
+
+package squirrel
+
+import (
+	sqlite "github.com/go-llsqlite/crawshaw"
+)
+
+// The online backup API isn't in the adapter, and differs between the sqlite implementations.
+type sqliteBackup struct {
+	b *sqlite.Backup
+}
+
+func newSqliteBackup(dest, src sqliteConn) (ret sqliteBackup, err error) {
+	ret.b, err = src.Conn.BackupInit("main", "main", dest.Conn)
+	return
+}
+
+func (me sqliteBackup) step(pages int) (done bool, err error) {
+	// This returns nil for SQLITE_OK and SQLITE_DONE alike.
+	err = me.b.Step(pages)
+	done = err == nil && me.b.Remaining() == 0
+	return
+}
+
+func (me sqliteBackup) remaining() int {
+	return me.b.Remaining()
+}
+
+func (me sqliteBackup) pageCount() int {
+	return me.b.PageCount()
+}
+
+func (me sqliteBackup) finish() error {
+	return me.b.Finish()
+}
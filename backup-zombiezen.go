@@ -0,0 +1,35 @@
+//go:build zombiezen_sqlite
+
+package squirrel
+
+import (
+	sqlite "zombiezen.com/go/sqlite"
+)
+
+// The online backup API isn't in the adapter, and differs between the sqlite implementations.
+type sqliteBackup struct {
+	b *sqlite.Backup
+}
+
+func newSqliteBackup(dest, src sqliteConn) (ret sqliteBackup, err error) {
+	ret.b, err = sqlite.NewBackup(dest, "main", src, "main")
+	return
+}
+
+func (me sqliteBackup) step(pages int) (done bool, err error) {
+	more, err := me.b.Step(pages)
+	done = err == nil && !more
+	return
+}
+
+func (me sqliteBackup) remaining() int {
+	return me.b.Remaining()
+}
+
+func (me sqliteBackup) pageCount() int {
+	return me.b.PageCount()
+}
+
+func (me sqliteBackup) finish() error {
+	return me.b.Close()
+}
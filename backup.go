@@ -0,0 +1,100 @@
+package squirrel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const defaultBackupStepPages = 1024
+
+type BackupOpts struct {
+	// Pages copied per backup step. Non-positive uses a default.
+	StepPages int
+	// If not nil, called after each step with the pages remaining and the total pages in the
+	// cache.
+	Progress func(remaining, total int)
+}
+
+// Writes a consistent copy of the cache to destPath while the cache stays in use, replacing any
+// existing file only once the copy is complete. See BackupWithOpts.
+func (c *Cache) Backup(ctx context.Context, destPath string) error {
+	return c.BackupWithOpts(ctx, destPath, BackupOpts{})
+}
+
+// Copies the cache with sqlite's online backup API. The copy is of the cache at the start of the
+// backup. Readers aren't affected, and in WAL mode writers aren't either. In other journal modes
+// writers wait for the backup to finish. The backup is abandoned between steps if ctx is done.
+func (c *Cache) BackupWithOpts(ctx context.Context, destPath string, opts BackupOpts) (err error) {
+	// Back up to a temporary file next to the destination, so it can be renamed into place.
+	f, err := os.CreateTemp(filepath.Dir(destPath), filepath.Base(destPath)+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmpPath := f.Name()
+	err = f.Close()
+	if err == nil {
+		err = c.withConn(func(conn conn) error {
+			return conn.backup(ctx, tmpPath, opts)
+		})
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, destPath)
+	}
+	if err != nil {
+		err = errors.Join(err, os.Remove(tmpPath))
+	}
+	return
+}
+
+func (conn conn) backup(ctx context.Context, destPath string, opts BackupOpts) (err error) {
+	stepPages := opts.StepPages
+	if stepPages <= 0 {
+		stepPages = defaultBackupStepPages
+	}
+	dest, err := newSqliteConn(NewConnOpts{Path: destPath})
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = errors.Join(err, dest.Close())
+	}()
+	// Holding a read transaction on the source pins it, so changes made through other connections
+	// can't make the backup restart.
+	err = conn.sqliteExec("begin")
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = errors.Join(err, conn.sqliteExec("rollback"))
+	}()
+	err = conn.sqliteExec("select count(*) from sqlite_master")
+	if err != nil {
+		return
+	}
+	b, err := newSqliteBackup(dest, conn.sqliteConn)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = errors.Join(err, b.finish())
+	}()
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		var done bool
+		done, err = b.step(stepPages)
+		if err != nil {
+			return
+		}
+		if opts.Progress != nil {
+			opts.Progress(b.remaining(), b.pageCount())
+		}
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package squirrel
+
+// A key and value for PutMany.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// The outcome for a key in GetMany. Err is ErrNotFound for missing keys.
+type GetResult struct {
+	Value []byte
+	Err   error
+}
+
+// Stores all the items in a single transaction, trimming once at the end. errs has an entry for
+// each item. Failed items are rolled back individually and the rest are still stored. err is for
+// the transaction as a whole, in which case nothing is stored.
+func (c *Cache) PutMany(items []KeyValue) (errs []error, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		errs, err = tx.PutMany(items)
+		return
+	})
+	if err != nil {
+		errs = nil
+	}
+	return
+}
+
+// See Cache.PutMany.
+func (tx *Tx) PutMany(items []KeyValue) (errs []error, err error) {
+	errs = make([]error, len(items))
+	for i, item := range items {
+		errs[i], err = tx.withSavepoint(func() error {
+			return tx.Put(item.Key, item.Value)
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Runs f in a savepoint, rolling back its changes if it fails. fErr is what f returned, and err is
+// for failures managing the savepoint.
+func (tx *Tx) withSavepoint(f func() error) (fErr, err error) {
+	err = tx.conn.sqliteExec("savepoint squirrel_item")
+	if err != nil {
+		return
+	}
+	fErr = f()
+	// Open blob handles prevent releasing the savepoint, and would be invalid after a rollback.
+	tx.conn.closeBlobs()
+	if fErr != nil {
+		err = tx.conn.sqliteExec("rollback to squirrel_item")
+		if err != nil {
+			return
+		}
+	}
+	err = tx.conn.sqliteExec("release squirrel_item")
+	return
+}
+
+// Reads all the keys in a single transaction. results has an entry for each key.
+func (c *Cache) GetMany(keys []string) (results []GetResult, err error) {
+	err = c.Tx(func(tx *Tx) error {
+		results = tx.GetMany(keys)
+		return nil
+	})
+	if err != nil {
+		results = nil
+	}
+	return
+}
+
+// See Cache.GetMany.
+func (tx *Tx) GetMany(keys []string) (results []GetResult) {
+	results = make([]GetResult, len(keys))
+	for i, key := range keys {
+		results[i].Value, results[i].Err = tx.ReadAll(key, nil)
+	}
+	return
+}
@@ -0,0 +1,116 @@
+// Package bazelCache serves the Bazel HTTP remote cache protocol from a squirrel Cache.
+package bazelCache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// Bazel appends these to the --remote_cache URL, which may have a path of its own. The path is kept
+// in keys, so different prefixes act as separate instances.
+var pathRegexp = regexp.MustCompile(`^/((?:.*/)?(ac|cas)/([0-9a-f]{64}))$`)
+
+// An http.Handler for GET, HEAD and PUT on /ac/{sha256} and /cas/{sha256}. Entries in the content
+// addressable store are verified to match their hash before they're written. Action cache entries
+// are stored as given.
+type Handler struct {
+	Cache *squirrel.Cache
+	// Prepended to keys, so Cache can be used for other things too.
+	KeyPrefix string
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+var errHashMismatch = errors.New("content doesn't match hash")
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := pathRegexp.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	key := h.KeyPrefix + m[1]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r, key)
+	case http.MethodPut:
+		h.put(w, r, key, m[2] == "cas", m[3])
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, key string) {
+	ki, err := h.Cache.Stat(key)
+	if errors.Is(err, squirrel.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// The zero modtime suppresses Last-Modified, which means nothing for content-addressed data.
+	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(h.Cache.NewBlobRef(key), 0, ki.Length))
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, key string, verify bool, hexHash string) {
+	err := h.spoolAndPut(r.Body, key, verify, hexHash)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, errHashMismatch):
+		http.Error(w, fmt.Sprintf("%v %v", errHashMismatch, hexHash), http.StatusBadRequest)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		http.Error(w, "body shorter than Content-Length", http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// The body is spooled and verified before it's stored, so the write transaction isn't held open
+// while a client uploads, and mismatched uploads never touch the cache.
+func (h *Handler) spoolAndPut(body io.Reader, key string, verify bool, hexHash string) (err error) {
+	f, err := os.CreateTemp("", "squirrel-bazel-cache-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	var (
+		dst    io.Writer = f
+		hasher hash.Hash
+	)
+	if verify {
+		hasher = sha256.New()
+		dst = io.MultiWriter(f, hasher)
+	}
+	length, err := io.Copy(dst, body)
+	if err != nil {
+		return
+	}
+	if verify {
+		want, _ := hex.DecodeString(hexHash)
+		if !bytes.Equal(hasher.Sum(nil), want) {
+			return errHashMismatch
+		}
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	return h.Cache.PutReader(key, f, length, nil)
+}
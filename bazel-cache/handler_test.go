@@ -0,0 +1,67 @@
+package bazelCache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/squirrel"
+)
+
+func do(c *qt.C, method, url, body string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	c.Assert(err, qt.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	return resp, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	c := qt.New(t)
+	cache := squirrel.TestingNewCache(c, squirrel.TestingDefaultCacheOpts(c))
+	server := httptest.NewServer(&Handler{Cache: cache})
+	defer server.Close()
+	const content = "some build output"
+	sum := sha256.Sum256([]byte(content))
+	casUrl := server.URL + "/cas/" + hex.EncodeToString(sum[:])
+
+	resp, _ := do(c, http.MethodGet, casUrl, "")
+	c.Check(resp.StatusCode, qt.Equals, http.StatusNotFound)
+	resp, _ = do(c, http.MethodPut, casUrl, "not the content")
+	c.Check(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+	resp, _ = do(c, http.MethodHead, casUrl, "")
+	c.Check(resp.StatusCode, qt.Equals, http.StatusNotFound)
+
+	resp, _ = do(c, http.MethodPut, casUrl, content)
+	c.Check(resp.StatusCode, qt.Equals, http.StatusOK)
+	resp, body := do(c, http.MethodGet, casUrl, "")
+	c.Check(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Check(body, qt.Equals, content)
+	resp, body = do(c, http.MethodHead, casUrl, "")
+	c.Check(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Check(resp.ContentLength, qt.Equals, int64(len(content)))
+	c.Check(body, qt.Equals, "")
+
+	// Action cache entries aren't checked against their hash, and instance prefixes are kept apart.
+	acUrl := server.URL + "/team/ac/" + strings.Repeat("ab", 32)
+	resp, _ = do(c, http.MethodPut, acUrl, "action result")
+	c.Check(resp.StatusCode, qt.Equals, http.StatusOK)
+	_, body = do(c, http.MethodGet, acUrl, "")
+	c.Check(body, qt.Equals, "action result")
+	resp, _ = do(c, http.MethodGet, server.URL+"/ac/"+strings.Repeat("ab", 32), "")
+	c.Check(resp.StatusCode, qt.Equals, http.StatusNotFound)
+
+	resp, _ = do(c, http.MethodPut, server.URL+"/cas/nothex", content)
+	c.Check(resp.StatusCode, qt.Equals, http.StatusNotFound)
+	resp, _ = do(c, http.MethodDelete, casUrl, "")
+	c.Check(resp.StatusCode, qt.Equals, http.StatusMethodNotAllowed)
+}
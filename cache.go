@@ -3,10 +3,13 @@ package squirrel
 import (
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"time"
 
 	"github.com/anacrolix/log"
 	"github.com/anacrolix/sync"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/ajwerner/btree"
 
@@ -23,6 +26,11 @@ type NewCacheOpts struct {
 	// Cache.
 	ConnBlockedOnBusy *chan struct{}
 	Logger            log.Logger
+	IncrementalVacuum IncrementalVacuumOpts
+	CapacityMode      CapacityMode
+	VolumeCapacity    VolumeCapacity
+	TrimWatermarks    TrimWatermarks
+	BackgroundTrim    BackgroundTrimOpts
 }
 
 func newConn(opts NewCacheOpts) (ret conn, err error) {
@@ -35,6 +43,14 @@ func newConn(opts NewCacheOpts) (ret conn, err error) {
 	ret.blobs = makeBlobCache()
 	ret.maxBlobSize = opts.MaxBlobSize.UnwrapOr(defaultMaxBlobSize)
 	ret.logger = opts.Logger
+	ret.incrementalVacuum = opts.IncrementalVacuum
+	ret.capacityMode = opts.CapacityMode
+	ret.volumeCapacity = opts.VolumeCapacity
+	ret.trimWatermarks = opts.TrimWatermarks
+	ret.backgroundTrim = opts.BackgroundTrim
+	if !opts.Memory {
+		ret.path = opts.Path
+	}
 	err = initConn(ret, opts)
 	if err != nil {
 		err = errors.Join(err, ret.Close())
@@ -79,7 +95,8 @@ func initConn(conn conn, opts NewCacheOpts) (err error) {
 	if err != nil {
 		return
 	}
-	err = conn.trimToCapacity(nil)
+	// This isn't in a transaction, so it's free to write.
+	err = conn.trimToCapacity(true, nil)
 	if err != nil {
 		return
 	}
@@ -120,16 +137,29 @@ func NewCache(opts NewCacheOpts) (_ *Cache, err error) {
 		cl.opts.Logger = log.Default
 	}
 	cl.closeCond.L = &cl.l
+	if opts.BackgroundTrim.Enabled {
+		cl.trimRequests = make(chan struct{}, 1)
+		cl.stopTrimmer = make(chan struct{})
+		cl.trimmerDone = make(chan struct{})
+	}
 	conn, err := cl.newConn()
 	if err != nil {
 		return
 	}
 	cl.addConn(conn)
+	if cl.trimRequests != nil {
+		go cl.runBackgroundTrimmer()
+	}
 	return cl, nil
 }
 
-func (cl *Cache) newConn() (conn, error) {
-	return newConn(cl.opts)
+func (cl *Cache) newConn() (conn conn, err error) {
+	conn, err = newConn(cl.opts)
+	if err != nil {
+		return
+	}
+	conn.trimRequests = cl.trimRequests
+	return
 }
 
 func (cl *Cache) addConn(conn conn) {
@@ -151,6 +181,37 @@ func (cl *Cache) GetCapacity() (ret int64, ok bool) {
 	return
 }
 
+// Sets the capacity stored in the database, which applies to all users of it. Keys are evicted
+// immediately if the cache is over the new capacity.
+func (cl *Cache) SetCapacity(capacity int64) error {
+	return cl.TxImmediate(func(tx *Tx) error {
+		return setCapacity(tx.conn.sqliteConn, capacity)
+	})
+}
+
+// Removes any capacity limit stored in the database.
+func (cl *Cache) UnlimitCapacity() error {
+	return cl.TxImmediate(func(tx *Tx) error {
+		return unlimitCapacity(tx.conn.sqliteConn)
+	})
+}
+
+// Evicts least recently used keys until the bytes used is no more than target, regardless of the
+// capacity. Returns the number of keys evicted. It's not an error if the target can't be reached
+// because all keys are evicted.
+func (cl *Cache) TrimTo(target int64) (evicted int, err error) {
+	err = cl.TxImmediate(func(tx *Tx) error {
+		err := tx.conn.trimTo(target, true, func(keyId rowid) {
+			evicted++
+		})
+		if err == errNoKeysToEvict {
+			err = nil
+		}
+		return err
+	})
+	return
+}
+
 func (cl *Cache) popConn() (ret conn) {
 	ret = cl.conns[len(cl.conns)-1]
 	cl.conns = cl.conns[:len(cl.conns)-1]
@@ -163,22 +224,28 @@ func (cl *Cache) pushConn(conn conn) {
 
 func (cl *Cache) withConn(with func(conn) error) (err error) {
 	cl.l.Lock()
+	// Compact needs all the conns to itself.
+	for cl.compacting {
+		cl.closeCond.Wait()
+	}
+	// Count the conn as in use before it's opened, so Compact waits for it.
+	cl.connsInUse++
+	var conn conn
 	if len(cl.conns) == 0 {
 		cl.l.Unlock()
-		var conn conn
 		conn, err = cl.newConn()
-		if err != nil {
-			return
-		}
 		cl.l.Lock()
-		cl.addConn(conn)
+	} else {
+		conn = cl.popConn()
 	}
-	conn := cl.popConn()
-	cl.connsInUse++
 	cl.l.Unlock()
-	err = with(conn)
+	if err == nil {
+		err = with(conn)
+	}
 	cl.l.Lock()
-	cl.pushConn(conn)
+	if conn != nil {
+		cl.pushConn(conn)
+	}
 	cl.connsInUse--
 	cl.closeCond.Broadcast()
 	cl.l.Unlock()
@@ -198,9 +265,18 @@ type Cache struct {
 	opts       NewCacheOpts
 	closeCond  sync.Cond
 	closed     bool
+	// Set while Compact has taken the conns.
+	compacting bool
 	// Anytime we know that we have to write to the sqlite conn, we should try to synchronize on a
 	// single connection for cache re-use and to minimize busy waits on multiple connections.
 	singleWriter sync.Mutex
+	// Calls to Loaders in GetOrLoad, by key.
+	loads singleflight.Group
+	// For the background trimmer, if it's enabled.
+	trimRequests    chan struct{}
+	stopTrimmer     chan struct{}
+	stopTrimmerOnce sync.Once
+	trimmerDone     chan struct{}
 }
 
 func (c *Cache) getCacheErr() error {
@@ -211,6 +287,8 @@ func (c *Cache) getCacheErr() error {
 }
 
 func (c *Cache) Close() (err error) {
+	// The trimmer uses conns, so it has to stop first.
+	c.stopBackgroundTrimmer()
 	c.l.Lock()
 	defer c.l.Unlock()
 	if !c.closed {
@@ -350,6 +428,44 @@ func (c *Cache) Put(name string, b []byte) (err error) {
 	return errors.Join(err, txErr)
 }
 
+// Stores the contents of r at name, replacing any existing value. If length is negative, r is first
+// spooled to a temporary file so the write transaction isn't held open while r is slowly produced.
+// If then is not nil, it's run in the same transaction after the value is written, such as to set
+// tags.
+func (c *Cache) PutReader(name string, r io.Reader, length int64, then func(tx *Tx) error) (err error) {
+	if length < 0 {
+		var f *os.File
+		f, err = os.CreateTemp("", "squirrel-spool-")
+		if err != nil {
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		length, err = io.Copy(f, r)
+		if err != nil {
+			return
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+		r = f
+	}
+	return c.TxImmediate(func(tx *Tx) (err error) {
+		err = tx.PutReader(name, r, length)
+		if err != nil || then == nil {
+			return
+		}
+		return then(tx)
+	})
+}
+
+func (c *Cache) Delete(name string) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.Delete(name)
+	})
+}
+
 func (c *Cache) ReadFull(key string, b []byte) (n int, err error) {
 	err = c.wrapTxMethod(func(tx *Tx) error {
 		n, err = tx.ReadFull(key, b)
@@ -367,45 +483,61 @@ func (c *Cache) ReadAll(key string, b []byte) (ret []byte, err error) {
 }
 
 func (c *Cache) runTx(f func(tx *Tx) error, level string) (err error) {
-	err = c.withConn(func(c conn) (err error) {
-		err = sqlitex.Exec(c.sqliteConn, "begin "+level, nil)
-		if err != nil {
-			return
-		}
-		tx := Tx{
-			conn:  c,
-			write: level != "",
-		}
-		err = f(&tx)
-		c.closeBlobs()
-		// TODO: Only trim when added to the database, or know that we upgraded to a write transaction already?
-		if err == nil {
-			err = c.trimToCapacity(func(key rowid) {
-				delete(tx.accessedKeys, key)
-			})
-		}
-		if err == nil {
-			for keyId := range tx.accessedKeys {
-				var ignored bool
-				ignored, err = c.accessedKey(keyId, !tx.write)
-				if err != nil || ignored {
-					break
-				}
+	return c.withConn(func(c conn) error {
+		return c.runTx(f, level)
+	})
+}
+
+func (c conn) runTx(f func(tx *Tx) error, level string) (err error) {
+	err = sqlitex.Exec(c.sqliteConn, "begin "+level, nil)
+	if err != nil {
+		return
+	}
+	tx := Tx{
+		conn:  c,
+		write: level != "",
+	}
+	err = f(&tx)
+	c.closeBlobs()
+	// TODO: Only trim when added to the database, or know that we upgraded to a write transaction already?
+	trimmed := false
+	if err == nil {
+		err = c.trimForTx(&tx, func(key rowid) {
+			trimmed = true
+			delete(tx.accessedKeys, key)
+		})
+	}
+	if err == nil {
+		for keyId := range tx.accessedKeys {
+			var ignored bool
+			ignored, err = c.accessedKey(keyId, !tx.write)
+			if err != nil || ignored {
+				break
 			}
 		}
-		if err == nil {
-			err = sqlitex.Exec(c.sqliteConn, "commit", nil)
-			return
-		}
-		// Autocommit is re-enabled if a transaction is automatically rolled back such as by SQLITE_FULL.
-		if !c.sqliteConn.GetAutocommit() {
-			rollbackErr := sqlitex.Exec(c.sqliteConn, "rollback", nil)
-			if rollbackErr != nil {
-				err = errors.Join(err, rollbackErr)
+	}
+	// Don't turn read transactions into writes just to vacuum.
+	if err == nil && tx.write {
+		err = c.maybeIncrementalVacuum(trimmed)
+	}
+	if err == nil {
+		err = sqlitex.Exec(c.sqliteConn, "commit", nil)
+		if err == nil && tx.write && c.capacityMode == CapacityFileSize {
+			// The transaction is committed, so don't fail it for this.
+			checkpointErr := c.checkpointIfOverCapacity()
+			if checkpointErr != nil {
+				c.logger.Levelf(log.Warning, "checkpointing to get under capacity: %v", checkpointErr)
 			}
 		}
 		return
-	})
+	}
+	// Autocommit is re-enabled if a transaction is automatically rolled back such as by SQLITE_FULL.
+	if !c.sqliteConn.GetAutocommit() {
+		rollbackErr := sqlitex.Exec(c.sqliteConn, "rollback", nil)
+		if rollbackErr != nil {
+			err = errors.Join(err, rollbackErr)
+		}
+	}
 	return
 }
 
@@ -0,0 +1,109 @@
+package squirrel
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/anacrolix/log"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// What the capacity limits.
+type CapacityMode int
+
+const (
+	// The capacity limits the bytes in pages holding data. Free pages, and the WAL or rollback
+	// journal, aren't counted. This is the default.
+	CapacityLivePages CapacityMode = iota
+	// The capacity limits what's on disk: the size of the database file, including free pages,
+	// plus its WAL. Free pages are vacuumed as keys are evicted if auto_vacuum is incremental,
+	// otherwise eviction stops once only free pages are over the capacity. Evicting keys can't
+	// shrink the WAL, so instead it's checkpointed and truncated after write transactions that
+	// leave the cache over capacity. The WAL can still exceed the capacity by a transaction, or more
+	// if readers hold up checkpoints.
+	CapacityFileSize
+)
+
+// How long to wait for readers to allow checkpointing the WAL before giving up until the next write
+// transaction.
+const capacityCheckpointTimeout = 100 * time.Millisecond
+
+// Returns the size of the WAL or rollback journal files.
+func (conn conn) journalBytes() (ret int64, err error) {
+	if conn.path == "" {
+		return
+	}
+	for _, suffix := range []string{"-wal", "-journal"} {
+		fi, statErr := os.Stat(conn.path + suffix)
+		if errors.Is(statErr, fs.ErrNotExist) {
+			continue
+		}
+		if statErr != nil {
+			err = statErr
+			return
+		}
+		ret += fi.Size()
+	}
+	return
+}
+
+// Returns free pages to the filesystem while trimming in CapacityFileSize mode.
+func (conn conn) reclaimFreePages() error {
+	// Frees the entire freelist. This does nothing unless auto_vacuum is incremental.
+	return conn.incrementalVacuumPages(0)
+}
+
+// Checkpoints and truncates the WAL if it puts the cache over capacity. This can't be done in a
+// transaction. It's not an error if readers prevent it.
+func (conn conn) checkpointIfOverCapacity() (err error) {
+	capacity, _, err := conn.effectiveCapacity()
+	if err != nil || !capacity.Ok {
+		return
+	}
+	used, err := conn.bytesUsed()
+	if err != nil {
+		return
+	}
+	journalBytes, err := conn.journalBytes()
+	if err != nil || used+journalBytes <= capacity.Value {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), capacityCheckpointTimeout)
+	defer cancel()
+	conn.sqliteConn.SetInterrupt(ctx.Done())
+	err = conn.sqliteExec("pragma wal_checkpoint(truncate)")
+	conn.sqliteConn.SetInterrupt(nil)
+	if sqlite.IsPrimaryResultCodeErr(err, sqlite.ResultCodeInterrupt) ||
+		sqlite.IsPrimaryResultCodeErr(err, sqlite.ResultCodeBusy) {
+		conn.logger.Levelf(log.Debug, "checkpointing to get under capacity: %v", err)
+		err = nil
+	}
+	return
+}
+
+// Hysteresis for trimming to capacity, so sustained writes don't pay for eviction on every commit.
+// Once usage exceeds the high watermark, keys are evicted down to the low watermark. Both are
+// fractions of the capacity. The zero value trims to the capacity whenever it's exceeded.
+type TrimWatermarks struct {
+	// Trimming starts when usage exceeds this fraction of the capacity. Zero means 1.
+	High float64
+	// Trimming evicts keys until usage is no more than this fraction of the capacity. Zero, or
+	// more than High, means High.
+	Low float64
+}
+
+// Returns the usage that triggers trimming, and the usage to trim down to.
+func (me TrimWatermarks) marks(capacity int64) (high, low int64) {
+	highFraction := me.High
+	if highFraction <= 0 {
+		highFraction = 1
+	}
+	lowFraction := me.Low
+	if lowFraction <= 0 || lowFraction > highFraction {
+		lowFraction = highFraction
+	}
+	return int64(highFraction * float64(capacity)), int64(lowFraction * float64(capacity))
+}
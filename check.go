@@ -0,0 +1,306 @@
+package squirrel
+
+import (
+	"fmt"
+	"strings"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+type CheckProblemKind string
+
+const (
+	// Reported by sqlite's pragma integrity_check. These can't be repaired here.
+	CheckProblemIntegrity CheckProblemKind = "integrity"
+	// A blob that isn't referenced by any value.
+	CheckProblemOrphanBlob CheckProblemKind = "orphan blob"
+	// A value chunk for a key that doesn't exist.
+	CheckProblemOrphanValue CheckProblemKind = "orphan value"
+	// A tag for a key that doesn't exist.
+	CheckProblemOrphanTag CheckProblemKind = "orphan tag"
+	// A value chunk that refers to a blob that doesn't exist.
+	CheckProblemMissingBlob CheckProblemKind = "missing blob"
+	// A key whose chunks have gaps or overlaps, or don't add up to its length.
+	CheckProblemBadCoverage CheckProblemKind = "bad coverage"
+)
+
+// An inconsistency found by Cache.Check or Cache.Repair.
+type CheckProblem struct {
+	Kind CheckProblemKind
+	// The key affected, if there is one.
+	Key    string
+	Detail string
+	// What was done to fix the problem. Empty if nothing was changed.
+	Repair string
+}
+
+func (me CheckProblem) String() string {
+	s := string(me.Kind)
+	if me.Key != "" {
+		s += fmt.Sprintf(" in %q", me.Key)
+	}
+	s += ": " + me.Detail
+	if me.Repair != "" {
+		s += " (" + me.Repair + ")"
+	}
+	return s
+}
+
+// Runs sqlite's integrity check, then checks the invariants squirrel relies on. Nothing is changed.
+func (c *Cache) Check() (problems []CheckProblem, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		problems, err = tx.conn.check(false)
+		return
+	})
+	return
+}
+
+// Like Check, but deletes or truncates inconsistent entries in a single write transaction. The
+// returned problems describe what was changed. Integrity problems can't be repaired, so it's an
+// error if sqlite's integrity check still fails afterwards.
+func (c *Cache) Repair() (problems []CheckProblem, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		problems, err = tx.conn.check(true)
+		return
+	})
+	if err != nil {
+		return
+	}
+	var msgs []string
+	err = c.Tx(func(tx *Tx) (err error) {
+		msgs, err = tx.conn.integrityCheck()
+		return
+	})
+	if err == nil && len(msgs) != 0 {
+		err = fmt.Errorf("integrity check still fails after repair: %v", strings.Join(msgs, "; "))
+	}
+	return
+}
+
+type checker struct {
+	conn     conn
+	repair   bool
+	problems []CheckProblem
+}
+
+func (conn conn) check(repair bool) (_ []CheckProblem, err error) {
+	c := checker{conn: conn, repair: repair}
+	for _, f := range []func() error{
+		c.integrity,
+		c.orphanValues,
+		c.orphanBlobs,
+		c.orphanTags,
+		c.coverage,
+	} {
+		err = f()
+		if err != nil {
+			break
+		}
+	}
+	return c.problems, err
+}
+
+func (c *checker) add(p CheckProblem, repair string) {
+	if c.repair {
+		p.Repair = repair
+	}
+	c.problems = append(c.problems, p)
+}
+
+func (c *checker) integrity() error {
+	msgs, err := c.conn.integrityCheck()
+	for _, msg := range msgs {
+		c.add(CheckProblem{Kind: CheckProblemIntegrity, Detail: msg}, "")
+	}
+	return err
+}
+
+// Returns the problems reported by sqlite's integrity check, if any.
+func (conn conn) integrityCheck() (msgs []string, err error) {
+	err = conn.sqliteQuery(`pragma integrity_check`, func(stmt *sqlite.Stmt) error {
+		if msg := stmt.ColumnText(0); msg != "ok" {
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+	return
+}
+
+// Finds rows with a query, reports each, and then deletes them all with another if repairing.
+func (c *checker) orphans(kind CheckProblemKind, find string, describe func(stmt *sqlite.Stmt) string, del string) (err error) {
+	found := 0
+	err = c.conn.sqliteQuery(find, func(stmt *sqlite.Stmt) error {
+		found++
+		c.add(CheckProblem{Kind: kind, Detail: describe(stmt)}, "deleted")
+		return nil
+	})
+	if err != nil || found == 0 || !c.repair {
+		return
+	}
+	return c.conn.sqliteExec(del)
+}
+
+func (c *checker) orphanValues() error {
+	return c.orphans(
+		CheckProblemOrphanValue,
+		`select value_id, offset from "values" where value_id not in (select key_id from keys)`,
+		func(stmt *sqlite.Stmt) string {
+			return fmt.Sprintf("key id %v offset %v", stmt.ColumnInt64(0), stmt.ColumnInt64(1))
+		},
+		`delete from "values" where value_id not in (select key_id from keys)`,
+	)
+}
+
+func (c *checker) orphanBlobs() error {
+	return c.orphans(
+		CheckProblemOrphanBlob,
+		`select blob_id from blobs where blob_id not in (select blob_id from "values")`,
+		func(stmt *sqlite.Stmt) string {
+			return fmt.Sprintf("blob id %v", stmt.ColumnInt64(0))
+		},
+		`delete from blobs where blob_id not in (select blob_id from "values")`,
+	)
+}
+
+func (c *checker) orphanTags() error {
+	return c.orphans(
+		CheckProblemOrphanTag,
+		`select key_id, tag_name from tags where key_id not in (select key_id from keys)`,
+		func(stmt *sqlite.Stmt) string {
+			return fmt.Sprintf("key id %v tag %q", stmt.ColumnInt64(0), stmt.ColumnText(1))
+		},
+		`delete from tags where key_id not in (select key_id from keys)`,
+	)
+}
+
+// The chunks seen for a key while checking coverage.
+type keyCoverage struct {
+	keyId  rowid
+	key    string
+	length int64
+	// The end of the contiguous chunks starting at offset zero, up to the first problem.
+	validEnd int64
+	// The offsets of those chunks. Any others are dropped by a repair.
+	validOffsets map[int64]struct{}
+	problem      string
+	problemKind  CheckProblemKind
+}
+
+func (c *checker) coverage() (err error) {
+	var (
+		bad     []keyCoverage
+		cur     keyCoverage
+		started bool
+	)
+	finish := func() {
+		if cur.problem == "" && cur.validEnd != cur.length {
+			cur.problem = fmt.Sprintf("chunks cover %v bytes, expected %v", cur.validEnd, cur.length)
+		}
+		if cur.problem != "" {
+			bad = append(bad, cur)
+		}
+	}
+	err = c.conn.sqliteQuery(
+		sqlQuery(`
+			select key_id, key, length, offset, length(blob), "values".blob_id is not null and blobs.blob_id is null
+			from keys left join "values" on value_id=key_id left join blobs using (blob_id)
+			order by key_id, offset`,
+		),
+		func(stmt *sqlite.Stmt) error {
+			keyId := stmt.ColumnInt64(0)
+			if !started || keyId != cur.keyId {
+				if started {
+					finish()
+				}
+				started = true
+				cur = keyCoverage{
+					keyId:       keyId,
+					key:         stmt.ColumnText(1),
+					length:      stmt.ColumnInt64(2),
+					problemKind: CheckProblemBadCoverage,
+				}
+			}
+			if cur.problem != "" || stmt.ColumnType(3) == sqlite.TypeNull {
+				return nil
+			}
+			offset := stmt.ColumnInt64(3)
+			blobLen := stmt.ColumnInt64(4)
+			switch {
+			case stmt.ColumnInt(5) != 0:
+				cur.problem = fmt.Sprintf("chunk at offset %v is missing its blob", offset)
+				cur.problemKind = CheckProblemMissingBlob
+			case offset > cur.validEnd:
+				cur.problem = fmt.Sprintf("gap from %v to %v", cur.validEnd, offset)
+			case offset < cur.validEnd:
+				cur.problem = fmt.Sprintf("chunk at offset %v overlaps previous chunk ending at %v", offset, cur.validEnd)
+			case offset+blobLen > cur.length:
+				cur.problem = fmt.Sprintf("chunk at offset %v extends past length %v", offset, cur.length)
+			default:
+				cur.validEnd = offset + blobLen
+				g.MakeMapIfNilAndSet(&cur.validOffsets, offset, struct{}{})
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return
+	}
+	if started {
+		finish()
+	}
+	for _, kc := range bad {
+		err = c.repairCoverage(kc)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Truncates the key to the valid prefix of its chunks, or deletes it if there isn't one.
+func (c *checker) repairCoverage(kc keyCoverage) (err error) {
+	p := CheckProblem{
+		Kind:   kc.problemKind,
+		Key:    kc.key,
+		Detail: kc.problem,
+	}
+	if kc.validEnd == 0 {
+		c.add(p, "deleted")
+		if c.repair {
+			err = c.conn.deleteKey(kc.key)
+		}
+		return
+	}
+	c.add(p, fmt.Sprintf("truncated to %v bytes", kc.validEnd))
+	if !c.repair {
+		return
+	}
+	// Chunks past the valid end aren't the only ones to go: overlapping chunks can start before it.
+	var invalidOffsets []int64
+	err = c.conn.sqliteQuery(
+		`select offset from "values" where value_id=?`,
+		func(stmt *sqlite.Stmt) error {
+			offset := stmt.ColumnInt64(0)
+			if !g.MapContains(kc.validOffsets, offset) {
+				invalidOffsets = append(invalidOffsets, offset)
+			}
+			return nil
+		},
+		kc.keyId,
+	)
+	if err != nil {
+		return
+	}
+	for _, offset := range invalidOffsets {
+		err = c.conn.sqliteExec(`delete from "values" where value_id=? and offset=?`, kc.keyId, offset)
+		if err != nil {
+			return
+		}
+	}
+	err = c.conn.sqliteExec(`update keys set length=? where key_id=?`, kc.validEnd, kc.keyId)
+	if err != nil {
+		return
+	}
+	return c.conn.forgetBlobsForKeyId(kc.keyId)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// A byte count that can be given on the command line as something like "10GiB".
+type byteSize int64
+
+func (me *byteSize) UnmarshalText(text []byte) error {
+	u, err := humanize.ParseBytes(string(text))
+	if err != nil {
+		return err
+	}
+	*me = byteSize(u)
+	return nil
+}
+
+func formatBytes(n int64) string {
+	return fmt.Sprintf("%v (%v)", humanize.IBytes(uint64(n)), n)
+}
+
+type CapacityCommand struct {
+	Get   *struct{}           `arg:"subcommand" help:"show the capacity (the default)"`
+	Set   *CapacitySetCommand `arg:"subcommand" help:"set the capacity, trimming if necessary"`
+	Unset *struct{}           `arg:"subcommand" help:"remove the capacity limit"`
+}
+
+type CapacitySetCommand struct {
+	Capacity byteSize `arg:"positional,required"`
+}
+
+func (me *CapacityCommand) Run(cache *squirrel.Cache) error {
+	switch {
+	case me.Set != nil:
+		return cache.SetCapacity(int64(me.Set.Capacity))
+	case me.Unset != nil:
+		return cache.UnlimitCapacity()
+	default:
+		capacity, ok := cache.GetCapacity()
+		if !ok {
+			fmt.Println("unlimited")
+		} else {
+			fmt.Println(formatBytes(capacity))
+		}
+		effective, effectiveOk, err := cache.EffectiveCapacity()
+		if err != nil {
+			return err
+		}
+		if effectiveOk && (!ok || effective != capacity) {
+			fmt.Printf("effective: %v\n", formatBytes(effective))
+		}
+		return nil
+	}
+}
+
+type TrimCommand struct {
+	To *byteSize `arg:"--to" help:"trim to this size instead of the capacity"`
+}
+
+func (me *TrimCommand) Run(cache *squirrel.Cache) (err error) {
+	before, err := cache.Usage()
+	if err != nil {
+		return
+	}
+	var target int64
+	if me.To != nil {
+		target = int64(*me.To)
+	} else {
+		var ok bool
+		target, ok = cache.GetCapacity()
+		if !ok {
+			return errors.New("cache has no capacity, use --to")
+		}
+	}
+	evicted, err := cache.TrimTo(target)
+	if err != nil {
+		return
+	}
+	after, err := cache.Usage()
+	if err != nil {
+		return
+	}
+	fmt.Printf(
+		"evicted %v keys, bytes used %v -> %v\n",
+		evicted, formatBytes(before.BytesUsed), formatBytes(after.BytesUsed),
+	)
+	return
+}
+
+type DuCommand struct{}
+
+type duBucket struct {
+	label string
+	keys  int64
+	bytes int64
+}
+
+func (me *duBucket) add(length int64) {
+	me.keys++
+	me.bytes += length
+}
+
+func (me *DuCommand) Run(cache *squirrel.Cache) (err error) {
+	usage, err := cache.Usage()
+	if err != nil {
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "bytes used:\t%v\n", formatBytes(usage.BytesUsed))
+	if capacity, ok := cache.GetCapacity(); ok {
+		fmt.Fprintf(tw, "capacity:\t%v\n", formatBytes(capacity))
+	} else {
+		fmt.Fprintf(tw, "capacity:\tunlimited\n")
+	}
+	fmt.Fprintf(tw, "page size:\t%v\n", usage.PageSize)
+	fmt.Fprintf(tw, "page count:\t%v\n", usage.PageCount)
+	fmt.Fprintf(tw, "freelist count:\t%v (%v)\n", usage.FreelistCount, humanize.IBytes(uint64(usage.FreelistCount*usage.PageSize)))
+	fmt.Fprintf(tw, "journal bytes:\t%v\n", formatBytes(usage.JournalBytes))
+	fmt.Fprintf(tw, "keys:\t%v\n", usage.Keys)
+	fmt.Fprintf(tw, "value bytes:\t%v\n", formatBytes(usage.ValueBytes))
+	err = tw.Flush()
+	if err != nil {
+		return
+	}
+	sizes := []duBucket{
+		{label: "< 1KiB"},
+		{label: "< 16KiB"},
+		{label: "< 256KiB"},
+		{label: "< 4MiB"},
+		{label: "< 64MiB"},
+		{label: ">= 64MiB"},
+	}
+	ages := []duBucket{
+		{label: "< 1h"},
+		{label: "< 1d"},
+		{label: "< 7d"},
+		{label: "< 30d"},
+		{label: ">= 30d"},
+	}
+	ageLimits := []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour}
+	now := time.Now()
+	err = cache.IterKeys("", func(ki squirrel.KeyInfo) bool {
+		sizeIndex := 0
+		for limit := int64(1 << 10); sizeIndex < len(sizes)-1 && ki.Length >= limit; limit <<= 4 {
+			sizeIndex++
+		}
+		sizes[sizeIndex].add(ki.Length)
+		ageIndex := 0
+		for ageIndex < len(ageLimits) && now.Sub(ki.LastUsed) >= ageLimits[ageIndex] {
+			ageIndex++
+		}
+		ages[ageIndex].add(ki.Length)
+		return true
+	})
+	if err != nil {
+		return
+	}
+	printDuBuckets("size", sizes)
+	printDuBuckets("last used", ages)
+	return
+}
+
+func printDuBuckets(title string, buckets []duBucket) {
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%v\tkeys\tbytes\t\n", title)
+	for _, b := range buckets {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t\n", b.label, b.keys, humanize.IBytes(uint64(b.bytes)))
+	}
+	tw.Flush()
+}
+
+type FsckCommand struct {
+	Repair bool `arg:"--repair" help:"delete or truncate inconsistent entries"`
+}
+
+func (me *FsckCommand) Run(cache *squirrel.Cache) (err error) {
+	var problems []squirrel.CheckProblem
+	if me.Repair {
+		problems, err = cache.Repair()
+	} else {
+		problems, err = cache.Check()
+	}
+	// Repairs are shown even if problems remain.
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if err != nil {
+		return
+	}
+	if len(problems) != 0 && !me.Repair {
+		return fmt.Errorf("found %v problems", len(problems))
+	}
+	return
+}
+
+type BackupCommand struct {
+	Dest  string `arg:"positional,required" help:"path for the backup, replaced once the backup is complete"`
+	Quiet bool   `arg:"-q" help:"don't show progress"`
+}
+
+func (me *BackupCommand) Run(cache *squirrel.Cache) (err error) {
+	// Interrupting abandons the backup, and doesn't leave a partial one behind.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var opts squirrel.BackupOpts
+	if !me.Quiet {
+		opts.Progress = func(remaining, total int) {
+			fmt.Fprintf(os.Stderr, "\rcopied %v/%v pages", total-remaining, total)
+		}
+	}
+	err = cache.BackupWithOpts(ctx, me.Dest, opts)
+	if !me.Quiet {
+		fmt.Fprintln(os.Stderr)
+	}
+	return
+}
+
+type CompactCommand struct{}
+
+func (me *CompactCommand) Run(cache *squirrel.Cache) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	reclaimed, err := cache.Compact(ctx)
+	if err != nil {
+		return
+	}
+	fmt.Printf("reclaimed %v\n", formatBytes(reclaimed))
+	return
+}
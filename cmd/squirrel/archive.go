@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/anacrolix/squirrel"
+)
+
+type ExportCommand struct {
+	Output string `arg:"-o" help:"write the archive to this file instead of stdout"`
+}
+
+func (me *ExportCommand) Run(cache *squirrel.Cache) (err error) {
+	var w io.Writer = os.Stdout
+	if me.Output != "" {
+		f, err := os.Create(me.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, f.Close())
+		}()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	err = cache.Export(bw)
+	if err != nil {
+		return
+	}
+	return bw.Flush()
+}
+
+type ImportCommand struct {
+	Input string `arg:"positional" help:"tar archive to import, or - for stdin" default:"-"`
+}
+
+func (me *ImportCommand) Run(cache *squirrel.Cache) (err error) {
+	f := os.Stdin
+	if me.Input != "-" {
+		f, err = os.Open(me.Input)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+	}
+	return cache.Import(bufio.NewReader(f))
+}
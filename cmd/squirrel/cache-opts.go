@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// Options for opening an existing cache. These mirror the fields of squirrel.NewCacheOpts that are
+// useful from the command line.
+type CacheOpts struct {
+	Db          string `arg:"-d,--db,env:SQUIRREL_DB" help:"path to an existing cache database"`
+	JournalMode string `arg:"--journal-mode" help:"set the sqlite journal mode when opening"`
+	LockingMode string `arg:"--locking-mode" help:"set the sqlite locking mode when opening"`
+	Synchronous int    `arg:"--synchronous" help:"value for pragma synchronous"`
+	MmapSize    *int64 `arg:"--mmap-size" help:"value for pragma mmap_size, negative for the sqlite default"`
+	CacheSize   *int64 `arg:"--cache-size" help:"value for pragma cache_size"`
+	MaxBlobSize *int64 `arg:"--max-blob-size" help:"maximum size of blobs used to store values"`
+	// See squirrel.CapacityFileSize.
+	FileSizeCapacity bool `arg:"--file-size-capacity" help:"count the database and WAL or journal file sizes against the capacity"`
+	// See squirrel.VolumeCapacity.
+	VolumeMaxFraction float64   `arg:"--volume-max-fraction" help:"limit the cache to this fraction of its filesystem"`
+	VolumeMinFree     *byteSize `arg:"--volume-min-free" help:"limit the cache to leave this much free on its filesystem"`
+	// See squirrel.TrimWatermarks.
+	TrimHigh float64 `arg:"--trim-high" help:"fraction of the capacity at which trimming starts"`
+	TrimLow  float64 `arg:"--trim-low" help:"fraction of the capacity that trimming evicts down to"`
+	// See squirrel.BackgroundTrimOpts.
+	BackgroundTrim bool `arg:"--background-trim" help:"trim in the background instead of in every transaction"`
+}
+
+func (me CacheOpts) newCacheOpts() (opts squirrel.NewCacheOpts) {
+	opts.Path = me.Db
+	opts.SetJournalMode = me.JournalMode
+	opts.SetLockingMode = me.LockingMode
+	opts.SetSynchronous = me.Synchronous
+	if me.MmapSize != nil {
+		opts.MmapSizeOk = true
+		opts.MmapSize = *me.MmapSize
+	}
+	if me.CacheSize != nil {
+		opts.CacheSize.Set(*me.CacheSize)
+	}
+	if me.MaxBlobSize != nil {
+		opts.MaxBlobSize.Set(*me.MaxBlobSize)
+	}
+	if me.FileSizeCapacity {
+		opts.CapacityMode = squirrel.CapacityFileSize
+	}
+	opts.VolumeCapacity.MaxFraction = me.VolumeMaxFraction
+	if me.VolumeMinFree != nil {
+		opts.VolumeCapacity.MinFree = int64(*me.VolumeMinFree)
+	}
+	opts.TrimWatermarks = squirrel.TrimWatermarks{
+		High: me.TrimHigh,
+		Low:  me.TrimLow,
+	}
+	opts.BackgroundTrim.Enabled = me.BackgroundTrim
+	return
+}
+
+// Opens the cache, which must already exist. sqlite would otherwise happily create a new database
+// for a mistyped path.
+func (me CacheOpts) open() (*squirrel.Cache, error) {
+	if me.Db == "" {
+		return nil, errors.New("cache database path is required (--db or SQUIRREL_DB)")
+	}
+	_, err := os.Stat(me.Db)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := squirrel.NewCache(me.newCacheOpts())
+	if err != nil {
+		return nil, fmt.Errorf("opening cache: %w", err)
+	}
+	return cache, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// Serves the go command's GOCACHEPROG protocol: JSON requests on stdin, JSON responses on stdout.
+// Action IDs map to keys holding the output ID, with the output size and time in tags. Output IDs
+// map to keys holding the output. Reading both on a hit keeps them together in the LRU order. The
+// go command reads outputs from disk, so they're copied to files in a directory. A temporary
+// directory is removed on close, and files in --dir whose keys have been evicted are removed then.
+type GocacheprogCommand struct {
+	Prefix string `arg:"--prefix" default:"gocache/" help:"prefix for keys"`
+	Dir    string `arg:"--dir" help:"where to put output files for the go command, defaults to a temporary directory"`
+}
+
+// Tags on action keys.
+const (
+	gocacheSizeTag = "size"
+	gocacheTimeTag = "time"
+)
+
+// See cmd/go/internal/cacheprog in the Go distribution.
+type progRequest struct {
+	ID       int64
+	Command  string
+	ActionID []byte `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	// Older go commands sent OutputID as ObjectID.
+	ObjectID []byte `json:",omitempty"`
+	BodySize int64  `json:",omitempty"`
+}
+
+type progResponse struct {
+	ID            int64
+	Err           string     `json:",omitempty"`
+	KnownCommands []string   `json:",omitempty"`
+	Miss          bool       `json:",omitempty"`
+	OutputID      []byte     `json:",omitempty"`
+	Size          int64      `json:",omitempty"`
+	Time          *time.Time `json:",omitempty"`
+	DiskPath      string     `json:",omitempty"`
+}
+
+func (me *GocacheprogCommand) Run(cache *squirrel.Cache) (err error) {
+	dir := me.Dir
+	if dir == "" {
+		dir, err = os.MkdirTemp("", "squirrel-gocacheprog-")
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(dir)
+	} else {
+		err = os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return
+		}
+	}
+	s := gocacheprogServer{
+		cache:  cache,
+		prefix: me.Prefix,
+		dir:    dir,
+	}
+	err = s.serve(bufio.NewReader(os.Stdin), os.Stdout)
+	if me.Dir != "" {
+		err = errors.Join(err, s.prune())
+	}
+	return
+}
+
+type gocacheprogServer struct {
+	cache  *squirrel.Cache
+	prefix string
+	dir    string
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	bw  *bufio.Writer
+}
+
+// Reads requests until close or EOF. Requests are handled concurrently, as the go command allows.
+func (s *gocacheprogServer) serve(r io.Reader, w io.Writer) (err error) {
+	s.bw = bufio.NewWriter(w)
+	s.enc = json.NewEncoder(s.bw)
+	err = s.respond(progResponse{KnownCommands: []string{"get", "put", "close"}})
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(r)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		var req progRequest
+		err = dec.Decode(&req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("decoding request: %w", err)
+		}
+		var body []byte
+		if req.Command == "put" && req.BodySize > 0 {
+			// The body follows the request as a base64 JSON string.
+			err = dec.Decode(&body)
+			if err != nil {
+				return fmt.Errorf("decoding body for request %v: %w", req.ID, err)
+			}
+		}
+		if req.Command == "close" {
+			wg.Wait()
+			return s.respond(progResponse{ID: req.ID})
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := s.handle(req, body)
+			if err != nil {
+				resp = progResponse{Err: err.Error()}
+			}
+			resp.ID = req.ID
+			s.respond(resp)
+		}()
+	}
+}
+
+func (s *gocacheprogServer) respond(resp progResponse) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.enc.Encode(resp)
+	if err != nil {
+		return
+	}
+	return s.bw.Flush()
+}
+
+func (s *gocacheprogServer) handle(req progRequest, body []byte) (progResponse, error) {
+	switch req.Command {
+	case "get":
+		return s.get(req.ActionID)
+	case "put":
+		outputId := req.OutputID
+		if outputId == nil {
+			outputId = req.ObjectID
+		}
+		return s.put(req.ActionID, outputId, body)
+	default:
+		return progResponse{}, fmt.Errorf("unknown command %q", req.Command)
+	}
+}
+
+func (s *gocacheprogServer) actionKey(actionId []byte) string {
+	return s.prefix + "a/" + hex.EncodeToString(actionId)
+}
+
+func (s *gocacheprogServer) outputKey(outputId []byte) string {
+	return s.prefix + "o/" + hex.EncodeToString(outputId)
+}
+
+func (s *gocacheprogServer) get(actionId []byte) (resp progResponse, err error) {
+	var (
+		outputId []byte
+		tags     map[string]any
+		diskPath string
+		size     int64
+	)
+	err = s.cache.Tx(func(tx *squirrel.Tx) (err error) {
+		actionKey := s.actionKey(actionId)
+		outputId, err = readPinned(tx, actionKey)
+		if err != nil {
+			return
+		}
+		tags, err = tx.Tags(actionKey)
+		if err != nil {
+			return
+		}
+		diskPath, size, err = s.materialize(tx, outputId)
+		return
+	})
+	if errors.Is(err, squirrel.ErrNotFound) {
+		// The output may have been evicted without the action.
+		return progResponse{Miss: true}, nil
+	}
+	if err != nil {
+		return
+	}
+	mtime, _ := tags[gocacheTimeTag].(int64)
+	t := time.Unix(0, mtime)
+	return progResponse{
+		OutputID: outputId,
+		Size:     size,
+		Time:     &t,
+		DiskPath: diskPath,
+	}, nil
+}
+
+// Reads a value through a PinnedBlob, which unlike Tx.ReadAll counts as an access.
+func readPinned(tx *squirrel.Tx, key string) (b []byte, err error) {
+	pb, err := tx.OpenPinnedReadOnly(key)
+	if err != nil {
+		return
+	}
+	defer pb.Close()
+	b = make([]byte, pb.Length())
+	_, err = pb.ReadAt(b, 0)
+	return
+}
+
+// Copies an output to the directory, if it's not already there. Either way the output is read, so
+// it's used as recently as its action.
+func (s *gocacheprogServer) materialize(tx *squirrel.Tx, outputId []byte) (diskPath string, size int64, err error) {
+	pb, err := tx.OpenPinnedReadOnly(s.outputKey(outputId))
+	if err != nil {
+		return
+	}
+	defer pb.Close()
+	size = pb.Length()
+	diskPath = filepath.Join(s.dir, hex.EncodeToString(outputId))
+	if fi, statErr := os.Stat(diskPath); statErr == nil && fi.Size() == size {
+		if size != 0 {
+			_, err = pb.ReadAt(make([]byte, 1), 0)
+		}
+		// Empty outputs can't be read, but they cost next to nothing to miss.
+		return
+	}
+	err = writeFileAtomic(diskPath, io.NewSectionReader(pb, 0, size))
+	return
+}
+
+func (s *gocacheprogServer) put(actionId, outputId, body []byte) (resp progResponse, err error) {
+	if sum := sha256.Sum256(body); len(outputId) == len(sum) && string(outputId) != string(sum[:]) {
+		err = fmt.Errorf("output ID %x doesn't match body hash %x", outputId, sum)
+		return
+	}
+	now := time.Now()
+	actionKey := s.actionKey(actionId)
+	err = s.cache.TxImmediate(func(tx *squirrel.Tx) (err error) {
+		err = tx.Put(s.outputKey(outputId), body)
+		if err != nil {
+			return
+		}
+		err = tx.Put(actionKey, outputId)
+		if err != nil {
+			return
+		}
+		for name, value := range map[string]any{
+			gocacheSizeTag: int64(len(body)),
+			gocacheTimeTag: now.UnixNano(),
+		} {
+			err = tx.SetTag(actionKey, name, value)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	diskPath := filepath.Join(s.dir, hex.EncodeToString(outputId))
+	err = writeFileAtomic(diskPath, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	return progResponse{DiskPath: diskPath}, nil
+}
+
+// Removes files in the directory for outputs that are no longer in the cache, and temporary files
+// left behind by writers that didn't finish.
+func (s *gocacheprogServer) prune() (err error) {
+	outputPrefix := s.outputKey(nil)
+	present := make(map[string]struct{})
+	err = s.cache.IterKeys(outputPrefix, func(ki squirrel.KeyInfo) bool {
+		present[strings.TrimPrefix(ki.Key, outputPrefix)] = struct{}{}
+		return true
+	})
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if _, ok := present[name]; ok {
+			continue
+		}
+		if strings.Contains(name, ".tmp-") {
+			// Other sessions may share the directory, so leave recent ones.
+			fi, infoErr := e.Info()
+			if infoErr != nil || time.Since(fi.ModTime()) < time.Hour {
+				continue
+			}
+		} else if _, hexErr := hex.DecodeString(name); hexErr != nil {
+			// Not ours.
+			continue
+		}
+		err = errors.Join(err, os.Remove(filepath.Join(s.dir, name)))
+	}
+	return
+}
+
+// Writes r to a temporary file in the same directory and renames it into place, so concurrent
+// readers never see a partial file.
+func writeFileAtomic(path string, r io.Reader) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	_, err = io.Copy(f, r)
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// Runs a session with the given requests, and returns the responses by request ID.
+func runGocacheprogSession(c *qt.C, s *gocacheprogServer, reqs ...any) map[int64]progResponse {
+	var in, out bytes.Buffer
+	enc := json.NewEncoder(&in)
+	for _, r := range reqs {
+		c.Assert(enc.Encode(r), qt.IsNil)
+	}
+	c.Assert(s.serve(&in, &out), qt.IsNil)
+	dec := json.NewDecoder(&out)
+	var hello progResponse
+	c.Assert(dec.Decode(&hello), qt.IsNil)
+	c.Check(hello.KnownCommands, qt.DeepEquals, []string{"get", "put", "close"})
+	resps := make(map[int64]progResponse)
+	for {
+		var resp progResponse
+		err := dec.Decode(&resp)
+		if err == io.EOF {
+			return resps
+		}
+		c.Assert(err, qt.IsNil)
+		resps[resp.ID] = resp
+	}
+}
+
+func TestGocacheprog(t *testing.T) {
+	c := qt.New(t)
+	cache := squirrel.TestingNewCache(c, squirrel.TestingDefaultCacheOpts(c))
+	newServer := func() *gocacheprogServer {
+		return &gocacheprogServer{cache: cache, prefix: "gocache/", dir: c.TempDir()}
+	}
+	actionId := bytes.Repeat([]byte{1}, 32)
+	body := []byte("compiled output")
+	outputId := sha256.Sum256(body)
+
+	resps := runGocacheprogSession(c, newServer(),
+		progRequest{ID: 1, Command: "get", ActionID: actionId},
+		progRequest{ID: 2, Command: "put", ActionID: bytes.Repeat([]byte{2}, 32), OutputID: actionId, BodySize: int64(len(body))},
+		body,
+		progRequest{ID: 3, Command: "close"},
+	)
+	c.Check(resps[1].Miss, qt.IsTrue)
+	c.Check(resps[2].Err, qt.Contains, "doesn't match body hash")
+	c.Check(resps, qt.HasLen, 3)
+
+	resps = runGocacheprogSession(c, newServer(),
+		progRequest{ID: 1, Command: "put", ActionID: actionId, OutputID: outputId[:], BodySize: int64(len(body))},
+		body,
+		progRequest{ID: 2, Command: "close"},
+	)
+	c.Assert(resps[1].Err, qt.Equals, "")
+	b, err := os.ReadFile(resps[1].DiskPath)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, body)
+
+	// A new session has a new directory, so the output has to come from the cache.
+	resps = runGocacheprogSession(c, newServer(),
+		progRequest{ID: 1, Command: "get", ActionID: actionId},
+		progRequest{ID: 2, Command: "close"},
+	)
+	resp := resps[1]
+	c.Assert(resp.Err, qt.Equals, "")
+	c.Check(resp.Miss, qt.IsFalse)
+	c.Check(resp.OutputID, qt.DeepEquals, outputId[:])
+	c.Check(resp.Size, qt.Equals, int64(len(body)))
+	c.Check(resp.Time, qt.IsNotNil)
+	b, err = os.ReadFile(resp.DiskPath)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, body)
+}
+
+func TestGocacheprogDir(t *testing.T) {
+	c := qt.New(t)
+	cache := squirrel.TestingNewCache(c, squirrel.TestingDefaultCacheOpts(c))
+	s := &gocacheprogServer{cache: cache, prefix: "gocache/", dir: c.TempDir()}
+	actionId := bytes.Repeat([]byte{1}, 32)
+	body := []byte("compiled output")
+	outputId := sha256.Sum256(body)
+	outputKey := s.outputKey(outputId[:])
+	resps := runGocacheprogSession(c, s,
+		progRequest{ID: 1, Command: "put", ActionID: actionId, OutputID: outputId[:], BodySize: int64(len(body))},
+		body,
+		progRequest{ID: 2, Command: "close"},
+	)
+	c.Assert(resps[1].Err, qt.Equals, "")
+	diskPath := resps[1].DiskPath
+	before, err := cache.Stat(outputKey)
+	c.Assert(err, qt.IsNil)
+
+	// The output is already on disk, but a hit still counts as using it.
+	resps = runGocacheprogSession(c, s,
+		progRequest{ID: 1, Command: "get", ActionID: actionId},
+		progRequest{ID: 2, Command: "close"},
+	)
+	c.Assert(resps[1].Err, qt.Equals, "")
+	c.Check(resps[1].DiskPath, qt.Equals, diskPath)
+	after, err := cache.Stat(outputKey)
+	c.Assert(err, qt.IsNil)
+	c.Check(after.AccessCount > before.AccessCount, qt.IsTrue)
+
+	c.Assert(s.prune(), qt.IsNil)
+	_, err = os.Stat(diskPath)
+	c.Check(err, qt.IsNil)
+	// Once the output is gone from the cache, so is its file.
+	c.Assert(cache.Delete(outputKey), qt.IsNil)
+	c.Assert(s.prune(), qt.IsNil)
+	_, err = os.Stat(diskPath)
+	c.Check(err, qt.ErrorIs, os.ErrNotExist)
+}
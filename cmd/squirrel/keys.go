@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anacrolix/squirrel"
+)
+
+type GetCommand struct {
+	Key    string `arg:"positional,required"`
+	Output string `arg:"-o" help:"write the value to this file instead of stdout"`
+}
+
+func (me *GetCommand) Run(cache *squirrel.Cache) (err error) {
+	pb, err := cache.OpenPinnedReadOnly(me.Key)
+	if err != nil {
+		return
+	}
+	defer pb.Close()
+	var w io.Writer = os.Stdout
+	if me.Output != "" {
+		f, err := os.Create(me.Output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, f.Close())
+		}()
+		w = f
+	}
+	_, err = io.Copy(w, io.NewSectionReader(pb, 0, pb.Length()))
+	return
+}
+
+type PutCommand struct {
+	Key   string `arg:"positional,required"`
+	Input string `arg:"positional" help:"file to read the value from, or - for stdin" default:"-"`
+}
+
+func (me *PutCommand) Run(cache *squirrel.Cache) (err error) {
+	f := os.Stdin
+	if me.Input != "-" {
+		f, err = os.Open(me.Input)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		// We need to know the length up front to create the value.
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		return cache.Put(me.Key, b)
+	}
+	pb, err := cache.Create(me.Key, squirrel.CreateOpts{Length: fi.Size()})
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = errors.Join(err, pb.Close())
+	}()
+	n, err := io.Copy(io.NewOffsetWriter(pb, 0), f)
+	if err == nil && n != fi.Size() {
+		err = fmt.Errorf("copied %v bytes but expected %v", n, fi.Size())
+	}
+	return
+}
+
+type RmCommand struct {
+	Keys []string `arg:"positional,required"`
+}
+
+func (me *RmCommand) Run(cache *squirrel.Cache) (err error) {
+	for _, key := range me.Keys {
+		deleteErr := cache.Delete(key)
+		if deleteErr != nil {
+			err = errors.Join(err, fmt.Errorf("deleting %q: %w", key, deleteErr))
+		}
+	}
+	return
+}
+
+type LsCommand struct {
+	Prefix string `arg:"--prefix" help:"only list keys starting with this prefix"`
+	Long   bool   `arg:"-l,--long" help:"show length, last used time and access count"`
+}
+
+func (me *LsCommand) Run(cache *squirrel.Cache) (err error) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+	err = cache.IterKeys(me.Prefix, func(ki squirrel.KeyInfo) bool {
+		if me.Long {
+			fmt.Fprintf(tw, "%v\t %v\t %v\t %s\n", ki.Length, formatTime(ki.LastUsed), ki.AccessCount, ki.Key)
+		} else {
+			fmt.Fprintln(tw, ki.Key)
+		}
+		return true
+	})
+	return errors.Join(err, tw.Flush())
+}
+
+type StatCommand struct {
+	Key string `arg:"positional,required"`
+}
+
+func (me *StatCommand) Run(cache *squirrel.Cache) (err error) {
+	ki, err := cache.Stat(me.Key)
+	if err != nil {
+		return
+	}
+	tags, err := cache.Tags(me.Key)
+	if err != nil {
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "key:\t%q\n", ki.Key)
+	fmt.Fprintf(tw, "length:\t%v\n", ki.Length)
+	fmt.Fprintf(tw, "created:\t%v\n", formatTime(ki.CreateTime))
+	fmt.Fprintf(tw, "last used:\t%v\n", formatTime(ki.LastUsed))
+	fmt.Fprintf(tw, "access count:\t%v\n", ki.AccessCount)
+	fmt.Fprintf(tw, "generation:\t%v\n", ki.Generation)
+	tagNames := make([]string, 0, len(tags))
+	for name := range tags {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+	for _, name := range tagNames {
+		fmt.Fprintf(tw, "tag %q:\t%#v\n", name, tags[name])
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// Takes the cache options rather than a cache, since importing into a new file has to create it.
+type ImportLegacyCommand struct {
+	Legacy string `arg:"positional" help:"legacy database to import into the cache, which is created if necessary. Without it, the cache database is converted in place"`
+}
+
+func (me *ImportLegacyCommand) Run(opts CacheOpts) (err error) {
+	var cache *squirrel.Cache
+	if me.Legacy == "" {
+		cache, err = opts.open()
+	} else {
+		if opts.Db == "" {
+			return errors.New("cache database path is required (--db or SQUIRREL_DB)")
+		}
+		// Don't create an empty database for a mistyped path.
+		_, err = os.Stat(me.Legacy)
+		if err != nil {
+			return
+		}
+		cache, err = squirrel.NewCache(opts.newCacheOpts())
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = errors.Join(err, cache.Close())
+	}()
+	var imported int
+	if me.Legacy == "" {
+		imported, err = cache.ConvertLegacy()
+	} else {
+		imported, err = cache.ImportLegacy(me.Legacy)
+	}
+	if err != nil {
+		return
+	}
+	fmt.Printf("imported %v keys\n", imported)
+	return
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"reflect"
 
 	"github.com/alexflint/go-arg"
 	"github.com/go-llsqlite/adapter"
@@ -15,6 +17,11 @@ type InitCommand struct {
 	Path string `arg:"positional"`
 }
 
+// A subcommand that operates on an existing cache.
+type cacheCommand interface {
+	Run(cache *squirrel.Cache) error
+}
+
 func main() {
 	err := mainErr()
 	if err != nil {
@@ -23,11 +30,40 @@ func main() {
 	}
 }
 
+type mainArgs struct {
+	CacheOpts
+	Init *InitCommand `arg:"subcommand"`
+	Get  *GetCommand  `arg:"subcommand" help:"write a value to stdout or a file"`
+	Put  *PutCommand  `arg:"subcommand" help:"store a value from a file or stdin"`
+	Rm   *RmCommand   `arg:"subcommand" help:"delete keys"`
+	Ls   *LsCommand   `arg:"subcommand" help:"list keys"`
+	Stat *StatCommand `arg:"subcommand" help:"show metadata and tags for a key"`
+
+	Capacity *CapacityCommand `arg:"subcommand" help:"show or change the cache capacity"`
+	Trim     *TrimCommand     `arg:"subcommand" help:"evict keys down to the capacity"`
+	Du       *DuCommand       `arg:"subcommand" help:"show disk usage and key statistics"`
+	Fsck     *FsckCommand     `arg:"subcommand" help:"check the cache for inconsistencies"`
+	Migrate  *MigrateCommand  `arg:"subcommand" help:"upgrade the cache schema to the latest version"`
+	Backup   *BackupCommand   `arg:"subcommand" help:"copy the cache to a file while it's in use"`
+	Compact  *CompactCommand  `arg:"subcommand" help:"rebuild the cache file without free space"`
+
+	Export *ExportCommand `arg:"subcommand" help:"write all keys to a tar archive"`
+	Import *ImportCommand `arg:"subcommand" help:"store the files in a tar archive as keys"`
+
+	ImportLegacy *ImportLegacyCommand `arg:"subcommand:import-legacy" help:"import a database using the legacy blob and blob_data tables"`
+
+	Gocacheprog *GocacheprogCommand `arg:"subcommand" help:"serve the go command's GOCACHEPROG protocol on stdin and stdout"`
+	BazelCache  *BazelCacheCommand  `arg:"subcommand:bazel-cache" help:"serve the Bazel HTTP remote cache protocol"`
+	Goproxy     *GoproxyCommand     `arg:"subcommand" help:"serve a caching Go module proxy (GOPROXY)"`
+}
+
 func mainErr() error {
-	var args struct {
-		Init *InitCommand `arg:"subcommand"`
-	}
+	var args mainArgs
 	p := arg.MustParse(&args)
+	return args.run(p)
+}
+
+func (args *mainArgs) run(p *arg.Parser) error {
 	switch {
 	case args.Init != nil:
 		conn, err := sqlite.OpenConn(args.Init.Path, 0)
@@ -36,8 +72,42 @@ func mainErr() error {
 		}
 		defer conn.Close()
 		return squirrel.InitSchema(conn, 1<<14, true)
+	case args.Migrate != nil:
+		return args.Migrate.Run(args.CacheOpts)
+	case args.ImportLegacy != nil:
+		return args.ImportLegacy.Run(args.CacheOpts)
 	default:
-		p.Fail("expected subcommand")
-		panic("unreachable")
+		cmd, ok := args.cacheCommand()
+		if !ok {
+			p.Fail("expected subcommand")
+			panic("unreachable")
+		}
+		return runCacheCommand(args.CacheOpts, cmd)
+	}
+}
+
+// Returns the chosen top-level subcommand if it runs on a cache. Nested subcommands, like capacity
+// set, are handled by their parent, so p.Subcommand can't be used.
+func (args *mainArgs) cacheCommand() (cacheCommand, bool) {
+	v := reflect.ValueOf(args).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() != reflect.Pointer || f.IsNil() {
+			continue
+		}
+		cmd, ok := f.Interface().(cacheCommand)
+		return cmd, ok
+	}
+	return nil, false
+}
+
+func runCacheCommand(opts CacheOpts, cmd cacheCommand) (err error) {
+	cache, err := opts.open()
+	if err != nil {
+		return
 	}
+	defer func() {
+		err = errors.Join(err, cache.Close())
+	}()
+	return cmd.Run(cache)
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/alexflint/go-arg"
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// Parses and runs a command line, as main does.
+func runCommandLine(c *qt.C, argv ...string) error {
+	var args mainArgs
+	p, err := arg.NewParser(arg.Config{}, &args)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.Parse(argv), qt.IsNil)
+	return args.run(p)
+}
+
+func TestNestedSubcommands(t *testing.T) {
+	c := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(c)
+	opts.Path = filepath.Join(c.TempDir(), "cache.db")
+	cache := squirrel.TestingNewCache(c, opts)
+	c.Assert(cache.Close(), qt.IsNil)
+	db := []string{"--db", opts.Path}
+	getCapacity := func() (capacity int64, ok bool) {
+		cache := squirrel.TestingNewCache(c, opts)
+		defer cache.Close()
+		return cache.GetCapacity()
+	}
+
+	c.Assert(runCommandLine(c, append(db, "capacity", "set", "10MiB")...), qt.IsNil)
+	capacity, ok := getCapacity()
+	c.Check(ok, qt.IsTrue)
+	c.Check(capacity, qt.Equals, int64(10<<20))
+	c.Check(runCommandLine(c, append(db, "capacity", "get")...), qt.IsNil)
+	c.Check(runCommandLine(c, append(db, "capacity")...), qt.IsNil)
+	c.Assert(runCommandLine(c, append(db, "capacity", "unset")...), qt.IsNil)
+	_, ok = getCapacity()
+	c.Check(ok, qt.IsFalse)
+}
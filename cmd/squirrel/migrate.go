@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-llsqlite/adapter"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// Works on the database directly, since opening a Cache would apply the migrations anyway.
+type MigrateCommand struct {
+	DryRun bool `arg:"--dry-run" help:"show pending migrations without applying them"`
+}
+
+func (me *MigrateCommand) Run(opts CacheOpts) (err error) {
+	if opts.Db == "" {
+		return errors.New("cache database path is required (--db or SQUIRREL_DB)")
+	}
+	conn, err := sqlite.OpenConn(opts.Db, sqlite.OpenReadWrite|sqlite.OpenNoMutex)
+	if err != nil {
+		return fmt.Errorf("opening sqlite conn: %w", err)
+	}
+	defer func() {
+		err = errors.Join(err, conn.Close())
+	}()
+	version, err := squirrel.GetSchemaVersion(conn)
+	if err != nil {
+		return
+	}
+	fmt.Printf("schema version %v, latest is %v\n", version, squirrel.LatestSchemaVersion())
+	var names []string
+	if me.DryRun {
+		names, err = squirrel.PendingMigrations(conn)
+	} else {
+		names, err = squirrel.Migrate(conn)
+	}
+	if err != nil {
+		return
+	}
+	verb := "applied"
+	if me.DryRun {
+		verb = "pending"
+	}
+	for _, name := range names {
+		fmt.Printf("%v: %v\n", verb, name)
+	}
+	return
+}
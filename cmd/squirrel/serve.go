@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/anacrolix/squirrel"
+	bazelCache "github.com/anacrolix/squirrel/bazel-cache"
+	"github.com/anacrolix/squirrel/goproxy"
+)
+
+type BazelCacheCommand struct {
+	Addr   string `arg:"--addr" default:"localhost:8080" help:"address to listen on"`
+	Prefix string `arg:"--prefix" help:"prefix for keys"`
+}
+
+func (me *BazelCacheCommand) Run(cache *squirrel.Cache) error {
+	l, err := net.Listen("tcp", me.Addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving bazel remote cache at http://%v", l.Addr())
+	return http.Serve(l, &bazelCache.Handler{
+		Cache:     cache,
+		KeyPrefix: me.Prefix,
+	})
+}
+
+type GoproxyCommand struct {
+	Addr     string        `arg:"--addr" default:"localhost:8080" help:"address to listen on"`
+	Upstream string        `arg:"--upstream" default:"https://proxy.golang.org" help:"module proxy to fetch from"`
+	Prefix   string        `arg:"--prefix" help:"prefix for keys"`
+	TTL      time.Duration `arg:"--ttl" default:"10m" help:"how long to use version lists and @latest before refetching"`
+}
+
+func (me *GoproxyCommand) Run(cache *squirrel.Cache) error {
+	upstream, err := url.Parse(me.Upstream)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", me.Addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving go module proxy for %v at http://%v", upstream, l.Addr())
+	return http.Serve(l, &goproxy.Handler{
+		Cache:     cache,
+		Upstream:  upstream,
+		KeyPrefix: me.Prefix,
+		ListTTL:   me.TTL,
+		LatestTTL: me.TTL,
+	})
+}
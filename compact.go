@@ -0,0 +1,136 @@
+package squirrel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Rebuilds the database into a new file without free pages, and swaps it in, returning the bytes
+// reclaimed. The Cache stays open, but operations wait for the compaction to finish. Other processes
+// must not have the cache open, since they would keep using the old file. If ctx is done before the
+// swap, the compaction is abandoned.
+func (c *Cache) Compact(ctx context.Context) (reclaimed int64, err error) {
+	if c.opts.Memory || c.opts.Path == "" {
+		err = errors.New("can only compact caches with a database file")
+		return
+	}
+	c.l.Lock()
+	for c.compacting {
+		c.closeCond.Wait()
+	}
+	c.compacting = true
+	for c.connsInUse != 0 {
+		c.closeCond.Wait()
+	}
+	// Close waits for this.
+	c.connsInUse++
+	conns := c.conns
+	c.conns = nil
+	c.l.Unlock()
+	var newConns []conn
+	defer func() {
+		c.l.Lock()
+		c.conns = append(c.conns, newConns...)
+		c.connsInUse--
+		c.compacting = false
+		c.closeCond.Broadcast()
+		c.l.Unlock()
+	}()
+	if len(conns) == 0 {
+		var conn conn
+		conn, err = c.newConn()
+		if err != nil {
+			return
+		}
+		conns = append(conns, conn)
+	}
+	tmpPath, err := c.vacuumInto(ctx, conns[0])
+	if err != nil {
+		// Nothing has changed, so the existing conns are still good.
+		newConns = conns
+		return
+	}
+	reclaimed, err = c.swapDatabase(conns, tmpPath)
+	// Whatever happened, the old conns are closed.
+	conn, newConnErr := c.newConn()
+	if newConnErr != nil {
+		err = errors.Join(err, fmt.Errorf("reopening cache: %w", newConnErr))
+		return
+	}
+	newConns = append(newConns, conn)
+	return
+}
+
+// Writes a compacted copy of the database to a new file next to it.
+func (c *Cache) vacuumInto(ctx context.Context, conn conn) (tmpPath string, err error) {
+	f, err := os.CreateTemp(filepath.Dir(c.opts.Path), filepath.Base(c.opts.Path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmpPath = f.Name()
+	err = f.Close()
+	if err == nil {
+		conn.sqliteConn.SetInterrupt(ctx.Done())
+		// VACUUM INTO accepts an existing empty file.
+		err = conn.sqliteExec(`vacuum into ?`, tmpPath)
+		conn.sqliteConn.SetInterrupt(nil)
+	}
+	if err == nil {
+		// VACUUM INTO doesn't sync its output.
+		err = syncFile(tmpPath)
+	}
+	if err != nil {
+		err = errors.Join(err, os.Remove(tmpPath))
+	}
+	return
+}
+
+// Closes conns and replaces the database with the file at newPath.
+func (c *Cache) swapDatabase(conns []conn, newPath string) (reclaimed int64, err error) {
+	for _, conn := range conns {
+		// In WAL mode, closing the last conn checkpoints into the main file.
+		err = errors.Join(err, conn.Close())
+	}
+	// A WAL or journal left behind would be applied to the new file.
+	for _, suffix := range []string{"-wal", "-journal"} {
+		_, statErr := os.Stat(c.opts.Path + suffix)
+		if statErr == nil {
+			err = errors.Join(err, fmt.Errorf("%v exists, is the cache open elsewhere?", c.opts.Path+suffix))
+		}
+	}
+	var oldSize, newSize int64
+	if err == nil {
+		oldSize, err = fileSize(c.opts.Path)
+	}
+	if err == nil {
+		newSize, err = fileSize(newPath)
+	}
+	if err == nil {
+		err = os.Rename(newPath, c.opts.Path)
+	}
+	if err != nil {
+		err = errors.Join(err, os.Remove(newPath))
+		return
+	}
+	reclaimed = oldSize - newSize
+	return
+}
+
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func syncFile(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	return errors.Join(f.Sync(), f.Close())
+}
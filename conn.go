@@ -18,10 +18,20 @@ import (
 type sqliteConn = *sqlite.Conn
 
 type connStruct struct {
-	sqliteConn  sqliteConn
-	blobs       btree.Map[valueKey, *sqlite.Blob]
-	maxBlobSize maxBlobSizeType
-	logger      log.Logger
+	sqliteConn        sqliteConn
+	blobs             btree.Map[valueKey, *sqlite.Blob]
+	maxBlobSize       maxBlobSizeType
+	logger            log.Logger
+	incrementalVacuum IncrementalVacuumOpts
+	capacityMode      CapacityMode
+	volumeCapacity    VolumeCapacity
+	volumeLimit       volumeLimit
+	trimWatermarks    TrimWatermarks
+	backgroundTrim    BackgroundTrimOpts
+	// Signals the Cache's background trimmer. Nil if it's not enabled.
+	trimRequests chan<- struct{}
+	// The database file, or empty if there isn't one.
+	path string
 }
 
 func (c conn) Close() error {
@@ -100,7 +110,7 @@ func InitSchema(conn sqliteConn, pageSize int, triggers bool) (err error) {
 	// By starting immediately into a write, we can block rather than get SQLITE_BUSY for trying to
 	// upgrade from a read later.
 	return sqlitex.WithTransactionRollbackOnError(conn, `immediate`, func() (err error) {
-		err = sqlitex.ExecScript(conn, initScript)
+		_, err = migrate(conn)
 		if err != nil {
 			return
 		}
@@ -171,6 +181,11 @@ func initDatabase(conn sqliteConn, opts InitDbOpts) (err error) {
 			err = fmt.Errorf("initing schema: %w", err)
 			return
 		}
+	} else {
+		err = checkSchemaVersion(conn)
+		if err != nil {
+			return
+		}
 	}
 	if opts.Capacity < 0 {
 		err = unlimitCapacity(conn)
@@ -356,12 +371,23 @@ func (conn conn) iterBlobs(
 	return
 }
 
+// Returns ErrNotFound for expired counters, like all reads.
 func (conn conn) openKey(key string) (ret keyCols, err error) {
+	ret, err = conn.lookupKey(key)
+	if err == nil && ret.expired {
+		err = ErrNotFound
+	}
+	return
+}
+
+// Like openKey, but includes expired counters, for writes that replace them.
+func (conn conn) lookupKey(key string) (ret keyCols, err error) {
 	ok, err := conn.sqliteQueryRow(
-		`select key_id, length from keys where key=?`,
+		`select key_id, length, `+counterExpiredExpr+` from keys where key=?`,
 		func(stmt *sqlite.Stmt) error {
 			ret.id = stmt.ColumnInt64(0)
 			ret.length = stmt.ColumnInt64(1)
+			ret.expired = stmt.ColumnInt(2) != 0
 			return nil
 		},
 		key,
@@ -376,16 +402,23 @@ func (conn conn) openKey(key string) (ret keyCols, err error) {
 }
 
 func (conn conn) createKey(key string, create CreateOpts) (keyId rowid, err error) {
-	cols, err := conn.openKey(key)
+	generation, err := conn.nextGeneration()
+	if err != nil {
+		return
+	}
+	cols, err := conn.lookupKey(key)
 	switch {
 	case err == nil:
-		if cols.length == create.Length {
+		if cols.length == create.Length && !cols.expired {
 			keyId = cols.id
+			// The caller is going to write to it.
+			err = conn.sqliteExec(
+				`update keys set generation=?, expires=null where key_id=?`, generation, keyId)
 			return
 		}
 		err = conn.deleteKey(key)
 		if err != nil && !errors.Is(err, ErrNotFound) {
-			err = fmt.Errorf("deleting existing item with different length: %w", err)
+			err = fmt.Errorf("deleting existing item with different length or expired: %w", err)
 			return
 		}
 	case errors.Is(err, ErrNotFound):
@@ -393,26 +426,40 @@ func (conn conn) createKey(key string, create CreateOpts) (keyId rowid, err erro
 		return
 	}
 	err = conn.sqliteQueryMustOneRow(
-		`insert into keys (key, length) values (?, ?) returning key_id`,
+		`insert into keys (key, length, generation) values (?, ?, ?) returning key_id`,
 		func(stmt *sqlite.Stmt) error {
 			keyId = stmt.ColumnInt64(0)
 			return nil
 		},
 		key,
 		create.Length,
+		generation,
 	)
 	if err != nil {
 		return
 	}
-	for off := int64(0); off < create.Length; off += conn.maxBlobSize {
-		blobSize := create.Length - off
+	err = conn.insertBlobs(keyId, create.Length, nil)
+	return
+}
+
+// Adds the blobs for a value of length. They're zeroed, unless b is given.
+func (conn conn) insertBlobs(keyId rowid, length int64, b []byte) (err error) {
+	for off := int64(0); off < length; off += conn.maxBlobSize {
+		blobSize := length - off
 		if blobSize > conn.maxBlobSize {
 			blobSize = conn.maxBlobSize
 		}
-		err = conn.sqliteExec(
-			`insert into blobs (blob) values (zeroblob(?))`,
-			blobSize,
-		)
+		if b == nil {
+			err = conn.sqliteExec(
+				`insert into blobs (blob) values (zeroblob(?))`,
+				blobSize,
+			)
+		} else {
+			err = conn.sqliteExec(
+				`insert into blobs (blob) values (?)`,
+				b[off:off+blobSize],
+			)
+		}
 		if err != nil {
 			return
 		}
@@ -428,6 +475,32 @@ func (conn conn) createKey(key string, create CreateOpts) (keyId rowid, err erro
 	return
 }
 
+// Replaces the value of an existing key with b, keeping the key's row, and so its tags, create time
+// and access count.
+func (conn conn) rewriteValue(keyId rowid, b []byte) (err error) {
+	generation, err := conn.nextGeneration()
+	if err != nil {
+		return
+	}
+	err = conn.forgetBlobsForKeyId(keyId)
+	if err != nil {
+		return
+	}
+	// Blobs are deleted along with their values.
+	err = conn.sqliteExec(`delete from "values" where value_id=?`, keyId)
+	if err != nil {
+		return
+	}
+	err = conn.sqliteExec(
+		`update keys set length=?, generation=? where key_id=?`,
+		len(b), generation, keyId,
+	)
+	if err != nil {
+		return
+	}
+	return conn.insertBlobs(keyId, int64(len(b)), b)
+}
+
 const defaultMaxBlobSize int64 = 1 << 20
 
 func (conn conn) sqliteExec(query string, args ...any) error {
@@ -480,89 +553,181 @@ func (conn conn) forgetBlobsForKeyId(keyId rowid) (err error) {
 
 const logTrimmedKeys = true
 
-func (conn conn) trimToCapacity(eachKey func(keyId rowid)) (err error) {
-	capacity, err := conn.getCapacity()
+// Returned when trimming can't reach its target because there are no keys left.
+var errNoKeysToEvict = errors.New("couldn't find keys to delete")
+
+// write is whether free pages may be reclaimed, which read transactions mustn't do, since it would
+// need the write lock.
+func (conn conn) trimToCapacity(write bool, eachKey func(keyId rowid)) (err error) {
+	capacity, volumeBound, err := conn.effectiveCapacity()
 	if err != nil {
 		return
 	}
 	if !capacity.Ok {
 		return
 	}
-	for {
+	high, low := conn.trimWatermarks.marks(capacity.Value)
+	if low < high {
 		var bytesUsed int64
 		bytesUsed, err = conn.bytesUsed()
+		if err != nil || bytesUsed <= high {
+			return
+		}
+	}
+	err = conn.trimTo(low, write, eachKey)
+	if volumeBound && errors.Is(err, errNoKeysToEvict) {
+		// Other users of the filesystem have taken the space. The cache has done all it can, and
+		// failing would only stop it being used at all.
+		conn.logger.Levelf(log.Warning, "volume capacity %v exceeded with nothing left to evict", capacity.Value)
+		err = nil
+	}
+	return
+}
+
+// Evicts least recently used keys until bytesUsed is no more than target. Keys are evicted in
+// batches sized to free the excess, so usage is usually only checked again once.
+func (conn conn) trimTo(target int64, write bool, eachKey func(keyId rowid)) (err error) {
+	for {
+		var usage pageUsage
+		usage, err = conn.pageUsage()
 		if err != nil {
 			return
 		}
-		if bytesUsed <= capacity.Value {
+		if conn.bytesUsedFrom(usage) <= target {
 			return
 		}
-		var (
-			key         string
-			lastUsed    time.Time
-			accessCount int64
-			createTime  time.Time
-			length      int64
-			keyId       int64
-		)
-		ok, err := conn.sqliteQueryRow(
-			sqlQuery(`
-				delete from keys
-				where key_id=(select key_id from keys order by last_used, access_count, create_time limit 1)
-				returning key, last_used, access_count, create_time, length, key_id
-			`),
-			func(stmt *sqlite.Stmt) error {
-				if logTrimmedKeys {
-					key = stmt.ColumnText(0)
-					lastUsed = timeFromStmtColumn(stmt, 1)
-					accessCount = stmt.ColumnInt64(2)
-					createTime = timeFromStmtColumn(stmt, 3)
-					length = stmt.ColumnInt64(4)
-				}
-				keyId = stmt.ColumnInt64(5)
-				return nil
-			},
-		)
-		if err != nil {
-			return err
+		if write && conn.capacityMode == CapacityFileSize && usage.freelistCount != 0 {
+			// Evicting only moves pages to the freelist, so return them each time around.
+			err = conn.reclaimFreePages()
+			if err != nil {
+				return
+			}
+			usage, err = conn.pageUsage()
+			if err != nil {
+				return
+			}
+			if conn.bytesUsedFrom(usage) <= target {
+				return
+			}
 		}
-		if !ok {
-			return errors.New("couldn't find keys to delete")
+		// What's left over the target is free pages that couldn't be returned. They're reused before
+		// the file grows, so evicting more won't help.
+		if usage.liveBytes() <= target {
+			return
 		}
-		if eachKey != nil {
-			eachKey(keyId)
+		var evicted int
+		evicted, err = conn.evictBatch(usage.liveBytes()-target, eachKey)
+		if err != nil {
+			return
 		}
-		if logTrimmedKeys {
-			conn.logger.Levelf(
-				log.Debug,
-				"trimmed key %q (size %v, last used %v ago, access count %v, created %v ago)",
-				key,
-				length,
-				time.Since(lastUsed).Truncate(time.Second),
-				accessCount,
-				time.Since(createTime).Truncate(time.Second),
-			)
+		if evicted == 0 {
+			return errNoKeysToEvict
 		}
 	}
 }
 
+// Estimated bytes used by a key beyond its value, for sizing eviction batches. This keeps batches
+// of tiny keys from being unbounded.
+const evictionKeyOverhead = 128
+
+// The most keys evicted per statement, which bounds the keys considered for each batch.
+const maxEvictionBatch = 10000
+
+// Evicts least recently used keys until their lengths, plus an estimate of overhead, add up to
+// bytes. Pages are only freed when they're emptied, so this can fall short, and the caller should
+// check.
+func (conn conn) evictBatch(bytes int64, eachKey func(keyId rowid)) (evicted int, err error) {
+	err = conn.sqliteQuery(
+		sqlQuery(`
+			delete from keys
+			where key_id in (
+				select key_id from (
+					select
+						key_id,
+						length,
+						sum(length+?1) over (
+							order by last_used, access_count, create_time, key_id
+							rows unbounded preceding
+						) as total
+					from (
+						select key_id, length, last_used, access_count, create_time from keys
+						order by last_used, access_count, create_time, key_id
+						limit ?2
+					)
+				)
+				-- Include the key that reaches the target.
+				where total-(length+?1) < ?3
+			)
+			returning key, last_used, access_count, create_time, length, key_id
+		`),
+		func(stmt *sqlite.Stmt) error {
+			evicted++
+			keyId := stmt.ColumnInt64(5)
+			if eachKey != nil {
+				eachKey(keyId)
+			}
+			if logTrimmedKeys {
+				conn.logger.Levelf(
+					log.Debug,
+					"trimmed key %q (size %v, last used %v ago, access count %v, created %v ago)",
+					stmt.ColumnText(0),
+					stmt.ColumnInt64(4),
+					time.Since(timeFromStmtColumn(stmt, 1)).Truncate(time.Second),
+					stmt.ColumnInt64(2),
+					time.Since(timeFromStmtColumn(stmt, 3)).Truncate(time.Second),
+				)
+			}
+			return nil
+		},
+		evictionKeyOverhead,
+		maxEvictionBatch,
+		bytes,
+	)
+	return
+}
+
 func (conn conn) bytesUsed() (ret int64, err error) {
-	pages, err := conn.execPragmaReturningInt64("page_count")
+	usage, err := conn.pageUsage()
 	if err != nil {
 		return
 	}
-	pageSize, err := conn.execPragmaReturningInt64("page_size")
+	ret = conn.bytesUsedFrom(usage)
+	return
+}
+
+// Page counts of the main database, current within a transaction.
+type pageUsage struct {
+	pages         int64
+	pageSize      int64
+	freelistCount int64
+}
+
+func (me pageUsage) liveBytes() int64 {
+	return (me.pages - me.freelistCount) * me.pageSize
+}
+
+func (conn conn) pageUsage() (ret pageUsage, err error) {
+	ret.pages, err = conn.execPragmaReturningInt64("page_count")
 	if err != nil {
 		return
 	}
-	freelistCount, err := conn.execPragmaReturningInt64("freelist_count")
+	ret.pageSize, err = conn.execPragmaReturningInt64("page_size")
 	if err != nil {
 		return
 	}
-	ret = (pages - freelistCount) * pageSize
+	ret.freelistCount, err = conn.execPragmaReturningInt64("freelist_count")
 	return
 }
 
+// The usage compared against the capacity.
+func (conn conn) bytesUsedFrom(usage pageUsage) int64 {
+	if conn.capacityMode == CapacityFileSize {
+		// This is the main file size, but current within a transaction, unlike its size on disk.
+		return usage.pages * usage.pageSize
+	}
+	return usage.liveBytes()
+}
+
 func (conn conn) execPragmaReturningInt64(pragma string) (ret int64, err error) {
 	err = conn.sqliteQueryMustOneRow(fmt.Sprintf("pragma %v", pragma), func(stmt *sqlite.Stmt) error {
 		ret = stmt.ColumnInt64(0)
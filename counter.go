@@ -0,0 +1,166 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	sqlite "github.com/go-llsqlite/adapter"
+	"github.com/go-llsqlite/adapter/sqlitex"
+)
+
+// True for keys holding expired counters, which reads treat as missing until the key is next written.
+// keys.expires is when a counter with a TTL expires, in unix milliseconds, and null for other keys.
+const counterExpiredExpr = `(keys.expires is not null and keys.expires <= cast(unixepoch('subsec')*1e3 as integer))`
+
+// Expiry used to be kept in this tag, which made every read look it up.
+const legacyCounterExpiresTag = "squirrel.counter-expires"
+
+func addExpiresColumn(conn sqliteConn) (err error) {
+	found := false
+	err = sqlitex.Exec(conn, `select 1 from pragma_table_info('keys') where name='expires'`, func(stmt *sqlite.Stmt) error {
+		found = true
+		return nil
+	})
+	if err != nil || found {
+		return
+	}
+	return sqlitex.ExecScript(conn, `
+		alter table keys add column expires integer;
+		update keys set expires=(
+			select value from tags
+			where tags.key_id=keys.key_id and tag_name='`+legacyCounterExpiresTag+`'
+		);
+		delete from tags where tag_name='`+legacyCounterExpiresTag+`';
+	`)
+}
+
+type IncrOpts struct {
+	// If positive, a counter that's created gets this TTL. Once it expires, reads treat it as
+	// missing, and the next Incr starts it again from zero with a new TTL, which makes for fixed
+	// window rate limits.
+	TTL time.Duration
+}
+
+// Atomically adds delta to the integer stored at key, creating it with value delta if it doesn't
+// exist, and returns the new value. Counters are stored as decimal text, so they can be read like
+// any other value, and count towards capacity like any other key.
+func (c *Cache) Incr(key string, delta int64) (int64, error) {
+	return c.IncrWithOpts(key, delta, IncrOpts{})
+}
+
+// Like Incr, subtracting delta.
+func (c *Cache) Decr(key string, delta int64) (value int64, err error) {
+	delta, err = negateDelta(key, delta)
+	if err != nil {
+		return
+	}
+	return c.IncrWithOpts(key, delta, IncrOpts{})
+}
+
+// See Incr.
+func (c *Cache) IncrWithOpts(key string, delta int64, opts IncrOpts) (value int64, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		value, err = tx.IncrWithOpts(key, delta, opts)
+		return
+	})
+	return
+}
+
+// Returns the value of a counter. Expired counters are ErrNotFound.
+func (c *Cache) GetCounter(key string) (value int64, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		value, err = tx.GetCounter(key)
+		return
+	})
+	return
+}
+
+// See Cache.Incr.
+func (tx *Tx) Incr(key string, delta int64) (int64, error) {
+	return tx.IncrWithOpts(key, delta, IncrOpts{})
+}
+
+// See Cache.Decr.
+func (tx *Tx) Decr(key string, delta int64) (value int64, err error) {
+	delta, err = negateDelta(key, delta)
+	if err != nil {
+		return
+	}
+	return tx.IncrWithOpts(key, delta, IncrOpts{})
+}
+
+func negateDelta(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, fmt.Errorf("counter %q overflows", key)
+	}
+	return -delta, nil
+}
+
+// See Cache.Incr.
+func (tx *Tx) IncrWithOpts(key string, delta int64, opts IncrOpts) (value int64, err error) {
+	cols, err := tx.conn.lookupKey(key)
+	found := err == nil
+	switch {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return
+	case !cols.expired:
+		value, err = tx.readCounter(key)
+		if err != nil {
+			return
+		}
+	}
+	if (delta > 0 && value > math.MaxInt64-delta) || (delta < 0 && value < math.MinInt64-delta) {
+		err = fmt.Errorf("counter %q overflows", key)
+		return
+	}
+	value += delta
+	b := strconv.AppendInt(nil, value, 10)
+	if found {
+		// Keep the key's row, and so its tags, create time and access count.
+		err = tx.conn.rewriteValue(cols.id, b)
+	} else {
+		err = tx.Put(key, b)
+		if err == nil {
+			cols, err = tx.conn.lookupKey(key)
+		}
+	}
+	if err != nil {
+		return
+	}
+	expires := time.Now().Add(opts.TTL).UnixMilli()
+	switch {
+	case found && !cols.expired:
+		if opts.TTL > 0 {
+			// An existing TTL is kept, so the window doesn't move.
+			err = tx.conn.sqliteExec(
+				`update keys set expires=? where key_id=? and expires is null`, expires, cols.id)
+		}
+	case opts.TTL > 0:
+		err = tx.conn.sqliteExec(`update keys set expires=? where key_id=?`, expires, cols.id)
+	case found:
+		// It's starting again without a TTL.
+		err = tx.conn.sqliteExec(`update keys set expires=null where key_id=?`, cols.id)
+	}
+	return
+}
+
+// See Cache.GetCounter.
+func (tx *Tx) GetCounter(key string) (value int64, err error) {
+	return tx.readCounter(key)
+}
+
+func (tx *Tx) readCounter(key string) (value int64, err error) {
+	b, err := tx.ReadAll(key, nil)
+	if err != nil {
+		return
+	}
+	value, err = strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		err = fmt.Errorf("value of %q is not a counter: %w", key, err)
+	}
+	return
+}
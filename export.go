@@ -0,0 +1,247 @@
+package squirrel
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// PAX record names used to carry squirrel metadata in exported tar archives. Tag names are appended
+// to paxTagPrefix, query-escaped since PAX record keys can't contain '='.
+const (
+	paxCreateTime  = "SQUIRREL.create_time"
+	paxLastUsed    = "SQUIRREL.last_used"
+	paxAccessCount = "SQUIRREL.access_count"
+	paxExpires     = "SQUIRREL.expires"
+	paxTagPrefix   = "SQUIRREL.tag."
+)
+
+// Writes every key to w as a tar archive. Values are streamed a blob at a time, and the archive is a
+// consistent snapshot as it's produced in a single read transaction. Exporting doesn't count as an
+// access.
+func (c *Cache) Export(w io.Writer) error {
+	return c.Tx(func(tx *Tx) error {
+		return tx.Export(w)
+	})
+}
+
+// See Cache.Export.
+func (tx *Tx) Export(w io.Writer) (err error) {
+	tw := tar.NewWriter(w)
+	buf := make([]byte, 1<<16)
+	err = tx.conn.sqliteQuery(
+		`select `+keyInfoColumns+`, key_id, expires from keys order by key`,
+		func(stmt *sqlite.Stmt) error {
+			var expires g.Option[int64]
+			if stmt.ColumnType(7) != sqlite.TypeNull {
+				expires.Set(stmt.ColumnInt64(7))
+			}
+			return tx.conn.exportKey(tw, keyInfoFromStmt(stmt), stmt.ColumnInt64(6), expires, buf)
+		},
+	)
+	if err != nil {
+		return
+	}
+	return tw.Close()
+}
+
+func (conn conn) exportKey(
+	tw *tar.Writer, ki KeyInfo, keyId rowid, expires g.Option[int64], buf []byte,
+) (err error) {
+	tags, err := conn.tagsForKeyId(keyId)
+	if err != nil {
+		return
+	}
+	hdr := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ki.Key,
+		Size:     ki.Length,
+		Mode:     0o644,
+		ModTime:  ki.LastUsed,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			paxCreateTime:  strconv.FormatInt(ki.CreateTime.UnixMilli(), 10),
+			paxLastUsed:    strconv.FormatInt(ki.LastUsed.UnixMilli(), 10),
+			paxAccessCount: strconv.FormatInt(ki.AccessCount, 10),
+		},
+	}
+	if expires.Ok {
+		hdr.PAXRecords[paxExpires] = strconv.FormatInt(expires.Value, 10)
+	}
+	for name, value := range tags {
+		hdr.PAXRecords[paxTagPrefix+url.QueryEscape(name)] = encodePaxTagValue(value)
+	}
+	err = tw.WriteHeader(&hdr)
+	if err != nil {
+		return fmt.Errorf("writing header for %q: %w", ki.Key, err)
+	}
+	n, err := conn.writeValueTo(tw, keyId, buf)
+	if err != nil {
+		return fmt.Errorf("writing value for %q: %w", ki.Key, err)
+	}
+	if n != ki.Length {
+		return fmt.Errorf("value for %q has length %v, expected %v", ki.Key, n, ki.Length)
+	}
+	return
+}
+
+// Copies a value to w. Blobs are opened and closed one at a time rather than through the conn's
+// blob cache, so that walking many values doesn't accumulate open blob handles.
+func (conn conn) writeValueTo(w io.Writer, keyId rowid, buf []byte) (n int64, err error) {
+	err = conn.sqliteQuery(
+		`select offset, blob_id from "values" where value_id=? order by offset`,
+		func(stmt *sqlite.Stmt) (err error) {
+			offset := stmt.ColumnInt64(0)
+			if offset != n {
+				return fmt.Errorf("blob at offset %v, expected %v", offset, n)
+			}
+			blob, err := conn.openBlob(stmt.ColumnInt64(1), false)
+			if err != nil {
+				return
+			}
+			defer blob.Close()
+			n1, err := io.CopyBuffer(w, io.NewSectionReader(blob, 0, blob.Size()), buf)
+			n += n1
+			return
+		},
+		keyId,
+	)
+	return
+}
+
+func encodePaxTagValue(value any) string {
+	switch v := value.(type) {
+	case int64:
+		return "i:" + strconv.FormatInt(v, 10)
+	case float64:
+		return "f:" + strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return "s:" + v
+	case []byte:
+		return "b:" + base64.StdEncoding.EncodeToString(v)
+	default:
+		return "n:"
+	}
+}
+
+func decodePaxTagValue(s string) (any, error) {
+	kind, v, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed tag value %q", s)
+	}
+	switch kind {
+	case "i":
+		return strconv.ParseInt(v, 10, 64)
+	case "f":
+		return strconv.ParseFloat(v, 64)
+	case "s":
+		return v, nil
+	case "b":
+		return base64.StdEncoding.DecodeString(v)
+	case "n":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown tag value type %q", kind)
+	}
+}
+
+// Reads a tar archive from r, storing each regular file as a key, replacing any existing value.
+// Metadata and tags written by Export are restored. Other entry types are skipped, so archives from
+// other tools can be imported too. Each entry is imported in its own transaction.
+func (c *Cache) Import(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = c.TxImmediate(func(tx *Tx) error {
+			return tx.importEntry(hdr, tr)
+		})
+		if err != nil {
+			return fmt.Errorf("importing %q: %w", hdr.Name, err)
+		}
+	}
+}
+
+func (tx *Tx) importEntry(hdr *tar.Header, r io.Reader) (err error) {
+	keyId, err := tx.putReader(hdr.Name, r, hdr.Size)
+	if err != nil {
+		return
+	}
+	for k, v := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(k, paxTagPrefix)
+		if !ok {
+			continue
+		}
+		name, err = url.QueryUnescape(name)
+		if err != nil {
+			return
+		}
+		var value any
+		value, err = decodePaxTagValue(v)
+		if err != nil {
+			return fmt.Errorf("tag %q: %w", name, err)
+		}
+		err = tx.SetTag(hdr.Name, name, value)
+		if err != nil {
+			return
+		}
+	}
+	return tx.restoreKeyInfo(keyId, hdr)
+}
+
+// Applies the times, access count and counter expiry from an exported header, falling back to the
+// standard tar fields for archives from elsewhere.
+func (tx *Tx) restoreKeyInfo(keyId rowid, hdr *tar.Header) (err error) {
+	parseMs := func(name string, def time.Time) (int64, error) {
+		s, ok := hdr.PAXRecords[name]
+		if !ok {
+			return def.UnixMilli(), nil
+		}
+		return strconv.ParseInt(s, 10, 64)
+	}
+	createTime, err := parseMs(paxCreateTime, hdr.ModTime)
+	if err != nil {
+		return
+	}
+	lastUsed, err := parseMs(paxLastUsed, hdr.ModTime)
+	if err != nil {
+		return
+	}
+	var accessCount int64
+	if s, ok := hdr.PAXRecords[paxAccessCount]; ok {
+		accessCount, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	var expires any
+	if s, ok := hdr.PAXRecords[paxExpires]; ok {
+		expires, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.conn.sqliteExec(
+		`update keys set create_time=?, last_used=?, access_count=?, expires=? where key_id=?`,
+		createTime, lastUsed, accessCount, expires, keyId,
+	)
+	// Writing the value marked the key as accessed, which would clobber what we just restored.
+	delete(tx.accessedKeys, keyId)
+	return
+}
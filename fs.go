@@ -0,0 +1,313 @@
+package squirrel
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	g "github.com/anacrolix/generics"
+)
+
+// An fs.FS view of a Cache. Keys are files, with '/' in keys separating directories. Directories
+// exist implicitly when there are keys below them. Keys that aren't valid fs paths can't be reached.
+// If a key is also the parent directory of other keys, the file shadows the directory.
+type FS struct {
+	cache *Cache
+}
+
+var (
+	_ fs.FS         = FS{}
+	_ fs.StatFS     = FS{}
+	_ fs.ReadFileFS = FS{}
+	_ fs.ReadDirFS  = FS{}
+)
+
+// Returns an fs.FS view of the Cache. Reading files counts as accessing the keys.
+func (c *Cache) FS() FS {
+	return FS{cache: c}
+}
+
+func (me FS) Open(name string) (fs.File, error) {
+	fi, err := me.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &fsDir{fs: me, info: fi, name: name}, nil
+	}
+	return &fsFile{info: fi, blob: me.cache.NewBlobRef(name)}, nil
+}
+
+func (me FS) Stat(name string) (fs.FileInfo, error) {
+	return me.stat("stat", name)
+}
+
+func (me FS) stat(op, name string) (fi fsFileInfo, err error) {
+	if !fs.ValidPath(name) {
+		err = fs.ErrInvalid
+	} else {
+		err = me.cache.Tx(func(tx *Tx) error {
+			fi, err = tx.fsStat(name)
+			return err
+		})
+	}
+	if err != nil {
+		err = &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return
+}
+
+func (tx *Tx) fsStat(name string) (fi fsFileInfo, err error) {
+	if name == "." {
+		fi.name = "."
+		fi.dir = true
+		return
+	}
+	ki, err := tx.Stat(name)
+	if err == nil {
+		fi.KeyInfo = ki
+		fi.name = path.Base(name)
+		return
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return
+	}
+	err = tx.conn.iterKeys(name+"/", func(KeyInfo) bool {
+		fi.name = path.Base(name)
+		fi.dir = true
+		return false
+	})
+	if err == nil && !fi.dir {
+		err = fs.ErrNotExist
+	}
+	return
+}
+
+func (me FS) ReadFile(name string) (b []byte, err error) {
+	fi, err := me.stat("read", name)
+	if err != nil {
+		return
+	}
+	if fi.IsDir() {
+		err = &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+		return
+	}
+	b, err = me.cache.ReadAll(name, nil)
+	if err != nil {
+		err = &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return
+}
+
+func (me FS) ReadDir(name string) (entries []fs.DirEntry, err error) {
+	fi, err := me.stat("readdir", name)
+	if err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		err = &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		return
+	}
+	return me.readDir(name)
+}
+
+// Returns the sorted entries for a directory. Prefix queries are used, skipping past all the keys
+// in each subdirectory as it's found.
+func (me FS) readDir(name string) (entries []fs.DirEntry, err error) {
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	end, endOk := prefixEnd(prefix)
+	err = me.cache.Tx(func(tx *Tx) (err error) {
+		start := prefix
+		// A name can come up more than once, such as a key and a directory of keys below it, which
+		// needn't be adjacent: "a-b" sorts between "a" and "a/x". Keys sort before the directories
+		// they shadow, so the first one seen wins.
+		seen := make(map[string]struct{})
+		for {
+			var (
+				subdir   string
+				subdirOk bool
+			)
+			err = tx.conn.iterKeyRange(start, end, endOk, func(ki KeyInfo) bool {
+				child, _, isDir := strings.Cut(ki.Key[len(prefix):], "/")
+				if isDir {
+					// Skip the rest of the keys in the subdirectory.
+					subdir = child
+					subdirOk = true
+				}
+				if g.MapContains(seen, child) || !fs.ValidPath(child) {
+					return !isDir
+				}
+				seen[child] = struct{}{}
+				fi := fsFileInfo{name: child, dir: isDir}
+				if !isDir {
+					fi.KeyInfo = ki
+				}
+				entries = append(entries, fs.FileInfoToDirEntry(fi))
+				return !isDir
+			})
+			if err != nil || !subdirOk {
+				return
+			}
+			var ok bool
+			start, ok = prefixEnd(prefix + subdir + "/")
+			if !ok {
+				return
+			}
+		}
+	})
+	// Byte order of keys doesn't match name order, since '/' sorts after some other characters.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return
+}
+
+type fsFileInfo struct {
+	KeyInfo
+	name string
+	dir  bool
+}
+
+func (me fsFileInfo) Name() string {
+	return me.name
+}
+
+func (me fsFileInfo) Size() int64 {
+	return me.Length
+}
+
+func (me fsFileInfo) Mode() fs.FileMode {
+	if me.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+func (me fsFileInfo) ModTime() time.Time {
+	return me.LastUsed
+}
+
+func (me fsFileInfo) IsDir() bool {
+	return me.dir
+}
+
+// Returns the KeyInfo for files.
+func (me fsFileInfo) Sys() any {
+	if me.dir {
+		return nil
+	}
+	return me.KeyInfo
+}
+
+type fsFile struct {
+	info   fsFileInfo
+	blob   Blob
+	offset int64
+	closed bool
+}
+
+func (me *fsFile) Stat() (fs.FileInfo, error) {
+	return me.info, nil
+}
+
+func (me *fsFile) Read(b []byte) (n int, err error) {
+	n, err = me.ReadAt(b, me.offset)
+	me.offset += int64(n)
+	return
+}
+
+func (me *fsFile) ReadAt(b []byte, off int64) (n int, err error) {
+	if me.closed {
+		return 0, fs.ErrClosed
+	}
+	if off >= me.info.Length {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > me.info.Length-off {
+		b = b[:me.info.Length-off]
+	}
+	if len(b) == 0 {
+		return
+	}
+	n, err = me.blob.ReadAt(b, off)
+	if err == nil && off+int64(n) == me.info.Length {
+		err = io.EOF
+	}
+	return
+}
+
+func (me *fsFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += me.offset
+	case io.SeekEnd:
+		offset += me.info.Length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	me.offset = offset
+	return offset, nil
+}
+
+func (me *fsFile) Close() error {
+	if me.closed {
+		return fs.ErrClosed
+	}
+	me.closed = true
+	return nil
+}
+
+type fsDir struct {
+	fs      FS
+	info    fsFileInfo
+	name    string
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (me *fsDir) Stat() (fs.FileInfo, error) {
+	return me.info, nil
+}
+
+func (me *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: me.name, Err: errors.New("is a directory")}
+}
+
+func (me *fsDir) ReadDir(n int) (entries []fs.DirEntry, err error) {
+	if !me.read {
+		me.entries, err = me.fs.readDir(me.name)
+		if err != nil {
+			return
+		}
+		me.read = true
+	}
+	if n <= 0 {
+		entries = me.entries
+		me.entries = nil
+		return
+	}
+	if len(me.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(me.entries) {
+		n = len(me.entries)
+	}
+	entries = me.entries[:n]
+	me.entries = me.entries[n:]
+	return
+}
+
+func (me *fsDir) Close() error {
+	return nil
+}
@@ -0,0 +1,53 @@
+package squirrel_test
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/squirrel"
+)
+
+func TestFS(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for _, key := range []string{
+		"a",
+		"a-b",
+		// This sorts after "a-b", and is shadowed by "a".
+		"a/x",
+		"b/c",
+		"b/d/e",
+		"b/d/f",
+		"b/g",
+		"shadowed",
+		"shadowed/file",
+		// These aren't valid paths, and should be skipped.
+		"/abs",
+		"b//h",
+		"b/../i",
+	} {
+		qtc.Assert(cache.Put(key, []byte(key)), qt.IsNil)
+	}
+	fsys := cache.FS()
+	qtc.Assert(fstest.TestFS(fsys, "a", "a-b", "b/c", "b/d/e", "b/d/f", "b/g", "shadowed"), qt.IsNil)
+	var walked []string
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(walked, qt.DeepEquals, []string{
+		".", "a", "a-b", "b", "b/c", "b/d", "b/d/e", "b/d/f", "b/g", "shadowed",
+	})
+	b, err := fs.ReadFile(fsys, "b/d/e")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "b/d/e")
+	_, err = fs.Stat(fsys, "nope")
+	qtc.Check(err, qt.ErrorIs, fs.ErrNotExist)
+	fi, err := fs.Stat(fsys, "b/d")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(fi.IsDir(), qt.IsTrue)
+}
@@ -0,0 +1,144 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+	"github.com/go-llsqlite/adapter/sqlitex"
+)
+
+// Returned, possibly wrapped, when a Precondition isn't met.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Conditions on the current state of a key for a write to go ahead. The zero value always passes.
+// Combined with KeyInfo.Generation, these allow read-modify-write across processes sharing a
+// cache without other locking.
+type Precondition struct {
+	// The key must not exist.
+	IfAbsent bool
+	// The key must exist.
+	IfPresent bool
+	// The key must exist and have this generation.
+	IfGeneration g.Option[int64]
+}
+
+func IfAbsent() Precondition {
+	return Precondition{IfAbsent: true}
+}
+
+func IfPresent() Precondition {
+	return Precondition{IfPresent: true}
+}
+
+func IfGeneration(generation int64) Precondition {
+	return Precondition{IfGeneration: g.Some(generation)}
+}
+
+func (conn conn) checkPrecondition(key string, pre Precondition) (err error) {
+	if !pre.IfAbsent && !pre.IfPresent && !pre.IfGeneration.Ok {
+		return
+	}
+	var generation g.Option[int64]
+	err = conn.sqliteQuery(
+		`select generation from keys where key=? and not `+counterExpiredExpr,
+		func(stmt *sqlite.Stmt) error {
+			generation.Set(stmt.ColumnInt64(0))
+			return nil
+		},
+		key,
+	)
+	if err != nil {
+		return
+	}
+	switch {
+	case pre.IfAbsent && generation.Ok:
+		return fmt.Errorf("%w: %q exists", ErrPreconditionFailed, key)
+	case (pre.IfPresent || pre.IfGeneration.Ok) && !generation.Ok:
+		return fmt.Errorf("%w: %q doesn't exist", ErrPreconditionFailed, key)
+	case pre.IfGeneration.Ok && generation.Value != pre.IfGeneration.Value:
+		return fmt.Errorf(
+			"%w: %q has generation %v, expected %v",
+			ErrPreconditionFailed, key, generation.Value, pre.IfGeneration.Value,
+		)
+	}
+	return
+}
+
+// Returns a new generation, higher than any given before for this database.
+func (conn conn) nextGeneration() (generation int64, err error) {
+	err = conn.sqliteQueryMustOneRow(
+		`insert into setting (name, value) values ('generation', 1)
+		on conflict (name) do update set value=value+1
+		returning value`,
+		func(stmt *sqlite.Stmt) error {
+			generation = stmt.ColumnInt64(0)
+			return nil
+		},
+	)
+	return
+}
+
+// Migration adding key generations. Caches from before schema versioning may already have it.
+func addGenerationColumn(conn sqliteConn) (err error) {
+	found := false
+	err = sqlitex.Exec(conn, `select 1 from pragma_table_info('keys') where name='generation'`, func(stmt *sqlite.Stmt) error {
+		found = true
+		return nil
+	})
+	if err != nil || found {
+		return
+	}
+	return sqlitex.Exec(conn, `alter table keys add column generation integer not null default 0`, nil)
+}
+
+// Like Create, but fails with ErrPreconditionFailed if pre isn't met.
+func (tx *Tx) CreateIf(name string, opts CreateOpts, pre Precondition) (pb *PinnedBlob, err error) {
+	err = tx.conn.checkPrecondition(name, pre)
+	if err != nil {
+		return
+	}
+	return tx.Create(name, opts)
+}
+
+// Like Put, but fails with ErrPreconditionFailed if pre isn't met.
+func (tx *Tx) PutIf(name string, b []byte, pre Precondition) (err error) {
+	err = tx.conn.checkPrecondition(name, pre)
+	if err != nil {
+		return
+	}
+	return tx.Put(name, b)
+}
+
+// Like Delete, but fails with ErrPreconditionFailed if pre isn't met.
+func (tx *Tx) DeleteIf(name string, pre Precondition) (err error) {
+	err = tx.conn.checkPrecondition(name, pre)
+	if err != nil {
+		return
+	}
+	return tx.Delete(name)
+}
+
+// See Tx.CreateIf.
+func (c *Cache) CreateIf(name string, opts CreateOpts, pre Precondition) (ret CachePinnedBlob, err error) {
+	return c.getPinnedBlob(
+		c.TxImmediate,
+		func(tx *Tx) (*PinnedBlob, error) {
+			return tx.CreateIf(name, opts, pre)
+		})
+}
+
+// See Tx.PutIf.
+func (c *Cache) PutIf(name string, b []byte, pre Precondition) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.PutIf(name, b, pre)
+	})
+}
+
+// See Tx.DeleteIf.
+func (c *Cache) DeleteIf(name string, pre Precondition) error {
+	return c.TxImmediate(func(tx *Tx) error {
+		return tx.DeleteIf(name, pre)
+	})
+}
@@ -9,9 +9,12 @@ require (
 	github.com/anacrolix/generics v0.0.0-20230816105729-c755655aee45
 	github.com/anacrolix/log v0.14.3-0.20230823030427-4b296d71a6b4
 	github.com/anacrolix/sync v0.5.1
+	github.com/dustin/go-humanize v1.0.0
 	github.com/frankban/quicktest v1.14.6
 	github.com/go-llsqlite/adapter v0.0.0-20230927005056-7f5ce7f0c916
+	github.com/go-llsqlite/crawshaw v0.4.0
 	golang.org/x/sync v0.3.0
+	zombiezen.com/go/sqlite v0.13.1
 )
 
 require (
@@ -19,8 +22,6 @@ require (
 	github.com/anacrolix/chansync v0.3.0 // indirect
 	github.com/anacrolix/missinggo v1.2.1 // indirect
 	github.com/anacrolix/missinggo/perf v1.0.0 // indirect
-	github.com/dustin/go-humanize v1.0.0 // indirect
-	github.com/go-llsqlite/crawshaw v0.4.0 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/huandu/xstrings v1.2.0 // indirect
@@ -35,7 +36,6 @@ require (
 	modernc.org/mathutil v1.5.0 // indirect
 	modernc.org/memory v1.5.0 // indirect
 	modernc.org/sqlite v1.21.1 // indirect
-	zombiezen.com/go/sqlite v0.13.1 // indirect
 )
 
 retract (
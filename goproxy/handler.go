@@ -0,0 +1,210 @@
+// Package goproxy implements a caching Go module proxy (the GOPROXY protocol) on top of a squirrel
+// Cache.
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/squirrel"
+)
+
+const DefaultTTL = 10 * time.Minute
+
+// Tags on cached responses.
+const (
+	fetchedTag     = "fetched"
+	contentTypeTag = "content-type"
+)
+
+// An http.Handler serving the GOPROXY protocol from Upstream, caching responses in Cache. Versioned
+// .info, .mod and .zip files never change, so they're kept until evicted. The version list and
+// @latest are refetched once they're older than their TTL, but are served stale if Upstream can't be
+// reached, so a populated cache keeps working offline.
+type Handler struct {
+	Cache *squirrel.Cache
+	// The proxy to fetch from, like https://proxy.golang.org.
+	Upstream *url.URL
+	// http.DefaultClient if nil.
+	Client *http.Client
+	// Prepended to keys, so Cache can be used for other things too.
+	KeyPrefix string
+	// How long to use @v/list and @latest responses before refetching them. DefaultTTL if zero.
+	ListTTL   time.Duration
+	LatestTTL time.Duration
+	// log.Default if zero.
+	Logger log.Logger
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+func (h *Handler) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+func (h *Handler) logger() log.Logger {
+	if h.Logger.IsZero() {
+		return log.Default
+	}
+	return h.Logger
+}
+
+func ttlOrDefault(ttl time.Duration) time.Duration {
+	if ttl == 0 {
+		return DefaultTTL
+	}
+	return ttl
+}
+
+// Returns how long a response for the path may be used, with zero meaning forever, and the content
+// type to use if Upstream doesn't give one.
+func (h *Handler) classify(path string) (ttl time.Duration, contentType string, ok bool) {
+	switch {
+	case strings.HasSuffix(path, "/@latest"):
+		return ttlOrDefault(h.LatestTTL), "application/json", true
+	case strings.HasSuffix(path, "/@v/list"):
+		return ttlOrDefault(h.ListTTL), "text/plain; charset=utf-8", true
+	}
+	if !strings.Contains(path, "/@v/") {
+		return
+	}
+	switch {
+	case strings.HasSuffix(path, ".info"):
+		return 0, "application/json", true
+	case strings.HasSuffix(path, ".mod"):
+		return 0, "text/plain; charset=utf-8", true
+	case strings.HasSuffix(path, ".zip"):
+		return 0, "application/zip", true
+	}
+	return
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	ttl, defaultContentType, ok := h.classify(path)
+	if !ok || strings.Contains(path, "..") {
+		// This includes /sumdb/, which tells the go command to contact checksum databases directly.
+		http.NotFound(w, r)
+		return
+	}
+	key := h.KeyPrefix + path
+	cached, err := h.stat(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cached.ok && (ttl == 0 || time.Since(cached.fetched) < ttl) {
+		h.serveCached(w, r, cached, defaultContentType)
+		return
+	}
+	status, err := h.fetch(r, path, key)
+	if err == nil && status == http.StatusOK {
+		cached, err = h.stat(key)
+		if err == nil && cached.ok {
+			h.serveCached(w, r, cached, defaultContentType)
+			return
+		}
+	}
+	if cached.ok {
+		h.logger().Levelf(log.Warning, "serving stale %q: upstream status %v, error %v", path, status, err)
+		h.serveCached(w, r, cached, defaultContentType)
+		return
+	}
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case status == http.StatusNotFound || status == http.StatusGone:
+		// The go command treats these as "not found here" and moves on to the next proxy.
+		http.Error(w, "not found upstream", status)
+	default:
+		http.Error(w, fmt.Sprintf("upstream returned status %v", status), http.StatusBadGateway)
+	}
+}
+
+type cachedResponse struct {
+	ok          bool
+	key         string
+	length      int64
+	fetched     time.Time
+	contentType string
+}
+
+func (h *Handler) stat(key string) (cr cachedResponse, err error) {
+	err = h.Cache.Tx(func(tx *squirrel.Tx) (err error) {
+		ki, err := tx.Stat(key)
+		if err != nil {
+			return
+		}
+		tags, err := tx.Tags(key)
+		if err != nil {
+			return
+		}
+		fetched, _ := tags[fetchedTag].(int64)
+		contentType, _ := tags[contentTypeTag].(string)
+		cr = cachedResponse{
+			ok:          true,
+			key:         key,
+			length:      ki.Length,
+			fetched:     time.UnixMilli(fetched),
+			contentType: contentType,
+		}
+		return
+	})
+	if errors.Is(err, squirrel.ErrNotFound) {
+		err = nil
+	}
+	return
+}
+
+func (h *Handler) serveCached(w http.ResponseWriter, r *http.Request, cr cachedResponse, defaultContentType string) {
+	contentType := cr.contentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(h.Cache.NewBlobRef(cr.key), 0, cr.length))
+}
+
+// Fetches path from Upstream, storing it at key if it's found. The status is returned for
+// responses that aren't stored.
+func (h *Handler) fetch(r *http.Request, path, key string) (status int, err error) {
+	u := h.Upstream.JoinPath(path)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	fetched := time.Now()
+	contentType := resp.Header.Get("Content-Type")
+	// The body is spooled before storing it so the write transaction isn't held during the download.
+	err = h.Cache.PutReader(key, resp.Body, -1, func(tx *squirrel.Tx) (err error) {
+		err = tx.SetTag(key, fetchedTag, fetched.UnixMilli())
+		if err != nil || contentType == "" {
+			return
+		}
+		return tx.SetTag(key, contentTypeTag, contentType)
+	})
+	return resp.StatusCode, err
+}
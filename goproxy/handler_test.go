@@ -0,0 +1,110 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// A stand-in upstream proxy serving fixed files and counting requests for each path.
+type testUpstream struct {
+	mu    sync.Mutex
+	files map[string]string
+	hits  map[string]int
+}
+
+func (me *testUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.hits[r.URL.Path]++
+	content, ok := me.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	io.WriteString(w, content)
+}
+
+func (me *testUpstream) set(path, content string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.files[path] = content
+}
+
+func (me *testUpstream) hitsFor(path string) int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.hits[path]
+}
+
+func get(c *qt.C, url string) (int, string) {
+	resp, err := http.Get(url)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	return resp.StatusCode, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	c := qt.New(t)
+	upstream := &testUpstream{
+		files: map[string]string{
+			"/example.com/m/@v/list":        "v1.0.0\n",
+			"/example.com/m/@v/v1.0.0.info": `{"Version":"v1.0.0"}`,
+			"/example.com/m/@v/v1.0.0.mod":  "module example.com/m\n",
+			"/example.com/m/@v/v1.0.0.zip":  "zip bytes",
+			"/example.com/m/@latest":        `{"Version":"v1.0.0"}`,
+		},
+		hits: make(map[string]int),
+	}
+	upstreamServer := httptest.NewServer(upstream)
+	upstreamUrl, err := url.Parse(upstreamServer.URL)
+	c.Assert(err, qt.IsNil)
+	cache := squirrel.TestingNewCache(c, squirrel.TestingDefaultCacheOpts(c))
+	handler := &Handler{
+		Cache:    cache,
+		Upstream: upstreamUrl,
+		ListTTL:  time.Hour,
+	}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	for path, content := range upstream.files {
+		for range [2]struct{}{} {
+			status, body := get(c, proxy.URL+path)
+			c.Check(status, qt.Equals, http.StatusOK)
+			c.Check(body, qt.Equals, content)
+		}
+		c.Check(upstream.hitsFor(path), qt.Equals, 1, qt.Commentf("%v", path))
+	}
+	status, _ := get(c, proxy.URL+"/example.com/m/@v/v2.0.0.info")
+	c.Check(status, qt.Equals, http.StatusNotFound)
+	status, _ = get(c, proxy.URL+"/sumdb/sum.golang.org/supported")
+	c.Check(status, qt.Equals, http.StatusNotFound)
+
+	// The list expires, and is refetched.
+	handler.ListTTL = time.Nanosecond
+	upstream.set("/example.com/m/@v/list", "v1.0.0\nv1.1.0\n")
+	_, body := get(c, proxy.URL+"/example.com/m/@v/list")
+	c.Check(body, qt.Equals, "v1.0.0\nv1.1.0\n")
+	c.Check(upstream.hitsFor("/example.com/m/@v/list"), qt.Equals, 2)
+
+	// Without the upstream, stale and immutable responses are still served.
+	upstreamServer.Close()
+	status, body = get(c, proxy.URL+"/example.com/m/@v/list")
+	c.Check(status, qt.Equals, http.StatusOK)
+	c.Check(body, qt.Equals, "v1.0.0\nv1.1.0\n")
+	_, body = get(c, proxy.URL+"/example.com/m/@v/v1.0.0.zip")
+	c.Check(body, qt.Equals, "zip bytes")
+	status, _ = get(c, proxy.URL+"/example.com/other/@v/list")
+	c.Check(status, qt.Equals, http.StatusBadGateway)
+}
@@ -0,0 +1,48 @@
+package httpCache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed Cache-Control directives. Directives without arguments map to the empty string.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// Returns a delta-seconds directive argument. Invalid arguments aren't ok.
+func (cc cacheControl) seconds(name string) (d time.Duration, ok bool) {
+	s, ok := cc[name]
+	if !ok {
+		return
+	}
+	return parseDeltaSeconds(s)
+}
+
+func parseDeltaSeconds(s string) (d time.Duration, ok bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
@@ -0,0 +1,148 @@
+package httpCache
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// Tags on each stored response. The body is the value.
+const (
+	statusTag       = "status"
+	headerTag       = "header"
+	requestTimeTag  = "request-time"
+	responseTimeTag = "response-time"
+)
+
+// Statuses that can be stored and given a heuristic freshness lifetime without explicit freshness
+// information. See RFC 9110 section 15.1. Partial content isn't stored.
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Headers that apply to a single connection and aren't stored.
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+type storedResponse struct {
+	key          string
+	length       int64
+	status       int
+	header       http.Header
+	requestTime  time.Time
+	responseTime time.Time
+}
+
+func storedFromTags(ki squirrel.KeyInfo, tags map[string]any) (sr storedResponse, err error) {
+	status, ok1 := tags[statusTag].(int64)
+	header, ok2 := tags[headerTag].(string)
+	requestTime, ok3 := tags[requestTimeTag].(int64)
+	responseTime, ok4 := tags[responseTimeTag].(int64)
+	if !(ok1 && ok2 && ok3 && ok4) {
+		err = fmt.Errorf("missing or malformed tags on %q", ki.Key)
+		return
+	}
+	sr = storedResponse{
+		key:          ki.Key,
+		length:       ki.Length,
+		status:       int(status),
+		requestTime:  time.UnixMilli(requestTime),
+		responseTime: time.UnixMilli(responseTime),
+	}
+	sr.header, err = parseHeader(header)
+	return
+}
+
+func (sr storedResponse) setTags(tx *squirrel.Tx) (err error) {
+	for name, value := range map[string]any{
+		statusTag:       int64(sr.status),
+		headerTag:       formatHeader(sr.header),
+		requestTimeTag:  sr.requestTime.UnixMilli(),
+		responseTimeTag: sr.responseTime.UnixMilli(),
+	} {
+		err = tx.SetTag(sr.key, name, value)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func formatHeader(h http.Header) string {
+	var sb strings.Builder
+	h.Write(&sb)
+	return sb.String()
+}
+
+func parseHeader(s string) (http.Header, error) {
+	h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(s + "\r\n"))).ReadMIMEHeader()
+	return http.Header(h), err
+}
+
+// The age of the response now, per RFC 9111 section 4.2.3.
+func (sr storedResponse) currentAge(now time.Time) time.Duration {
+	date := sr.date()
+	apparentAge := nonNegative(sr.responseTime.Sub(date))
+	ageValue, _ := parseDeltaSeconds(sr.header.Get("Age"))
+	correctedAgeValue := ageValue + sr.responseTime.Sub(sr.requestTime)
+	return maxDuration(apparentAge, correctedAgeValue) + now.Sub(sr.responseTime)
+}
+
+func (sr storedResponse) date() time.Time {
+	date, err := http.ParseTime(sr.header.Get("Date"))
+	if err != nil {
+		return sr.responseTime
+	}
+	return date
+}
+
+// Per RFC 9111 section 4.2.1, with a heuristic of 10% of the time since Last-Modified.
+func (sr storedResponse) freshnessLifetime(cc cacheControl, shared bool) time.Duration {
+	if shared {
+		if d, ok := cc.seconds("s-maxage"); ok {
+			return d
+		}
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if s := sr.header.Get("Expires"); s != "" {
+		expires, err := http.ParseTime(s)
+		if err != nil {
+			// Invalid dates, like "0", mean already expired.
+			return 0
+		}
+		return nonNegative(expires.Sub(sr.date()))
+	}
+	if !heuristicallyCacheable[sr.status] {
+		return 0
+	}
+	lastModified, err := http.ParseTime(sr.header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	return nonNegative(sr.date().Sub(lastModified) / 10)
+}
+
+func (sr storedResponse) hasValidator() bool {
+	return sr.header.Get("ETag") != "" || sr.header.Get("Last-Modified") != ""
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	return maxDuration(d, 0)
+}
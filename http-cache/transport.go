@@ -0,0 +1,429 @@
+// Package httpCache implements a caching http.RoundTripper on top of a squirrel Cache, following
+// RFC 9111.
+package httpCache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// A caching http.RoundTripper. Responses to GET requests are stored in Cache, with the status and
+// headers in tags and the body as the value. Bodies stream into the Cache as they're read by the
+// caller, and are only stored if they're read to the end. Successful unsafe requests invalidate
+// stored responses for their URL.
+type Transport struct {
+	Cache *squirrel.Cache
+	// Makes requests that can't be satisfied by Cache. http.DefaultTransport if nil.
+	Transport http.RoundTripper
+	// Prepended to keys, so Cache can be used for other things too.
+	KeyPrefix string
+	// Behave as a shared cache: s-maxage applies, and private responses and responses to requests
+	// with Authorization aren't stored.
+	Shared bool
+	// Failures to update Cache don't fail requests, and are logged here. log.Default if zero.
+	Logger log.Logger
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+func (t *Transport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *Transport) logger() log.Logger {
+	if t.Logger.IsZero() {
+		return log.Default
+	}
+	return t.Logger
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return t.transport().RoundTrip(req)
+	default:
+		return t.roundTripUnsafe(req)
+	}
+	// Ranges and conditional requests made by the caller are passed through rather than being
+	// answered from partial or mismatched stored responses.
+	for _, name := range []string{"Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		if req.Header.Get(name) != "" {
+			return t.transport().RoundTrip(req)
+		}
+	}
+	reqCc := parseCacheControl(req.Header)
+	stored, ok, err := t.lookup(req)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if ok && t.usableWithoutValidation(req, reqCc, stored, now) {
+		return t.storedResponse(req, stored, now), nil
+	}
+	if reqCc.has("only-if-cached") {
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)),
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+	if ok && stored.hasValidator() {
+		return t.revalidate(req, reqCc, stored)
+	}
+	return t.fetch(req, reqCc, req)
+}
+
+// Keys for a URL all start with this. The rest of the key identifies the variant selected by Vary.
+func (t *Transport) urlPrefix(u *url.URL) string {
+	u2 := *u
+	u2.Fragment = ""
+	u2.RawFragment = ""
+	return t.KeyPrefix + u2.String() + "\x00"
+}
+
+// Returns the newest stored response that matches the request's URL and Vary headers.
+func (t *Transport) lookup(req *http.Request) (stored storedResponse, ok bool, err error) {
+	prefix := t.urlPrefix(req.URL)
+	var candidates []squirrel.KeyInfo
+	err = t.Cache.IterKeys(prefix, func(ki squirrel.KeyInfo) bool {
+		candidates = append(candidates, ki)
+		return true
+	})
+	if err != nil {
+		return
+	}
+	for _, ki := range candidates {
+		vary, parseErr := url.ParseQuery(ki.Key[len(prefix):])
+		if parseErr != nil || !varyMatches(vary, req) {
+			continue
+		}
+		var tags map[string]any
+		tags, err = t.Cache.Tags(ki.Key)
+		if errors.Is(err, squirrel.ErrNotFound) {
+			// Evicted since we listed it.
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		sr, tagsErr := storedFromTags(ki, tags)
+		if tagsErr != nil {
+			t.logger().Levelf(log.Warning, "ignoring stored response: %v", tagsErr)
+			continue
+		}
+		if !ok || sr.responseTime.After(stored.responseTime) {
+			stored = sr
+			ok = true
+		}
+	}
+	return
+}
+
+// The request header values selected by Vary, in the form they're kept in keys.
+func varyValue(req *http.Request, name string) string {
+	return strings.Join(req.Header.Values(name), ", ")
+}
+
+func varyMatches(vary url.Values, req *http.Request) bool {
+	for name, values := range vary {
+		if len(values) != 1 || varyValue(req, name) != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Transport) usableWithoutValidation(
+	req *http.Request, reqCc cacheControl, stored storedResponse, now time.Time,
+) bool {
+	resCc := parseCacheControl(stored.header)
+	if reqCc.has("no-cache") || resCc.has("no-cache") {
+		return false
+	}
+	if len(reqCc) == 0 && req.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	age := stored.currentAge(now)
+	if maxAge, ok := reqCc.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	minFresh, _ := reqCc.seconds("min-fresh")
+	lifetime := stored.freshnessLifetime(resCc, t.Shared)
+	if lifetime > age+minFresh {
+		return true
+	}
+	// Stale.
+	if resCc.has("must-revalidate") || (t.Shared && (resCc.has("proxy-revalidate") || resCc.has("s-maxage"))) {
+		return false
+	}
+	maxStale, ok := reqCc["max-stale"]
+	if !ok {
+		return false
+	}
+	if maxStale == "" {
+		return true
+	}
+	d, ok := parseDeltaSeconds(maxStale)
+	return ok && age-lifetime <= d
+}
+
+func (t *Transport) storedResponse(req *http.Request, stored storedResponse, now time.Time) *http.Response {
+	header := stored.header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(stored.currentAge(now)/time.Second), 10))
+	header.Set("Content-Length", strconv.FormatInt(stored.length, 10))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", stored.status, http.StatusText(stored.status)),
+		StatusCode:    stored.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: stored.length,
+		Body:          io.NopCloser(io.NewSectionReader(t.Cache.NewBlobRef(stored.key), 0, stored.length)),
+		Request:       req,
+	}
+}
+
+func (t *Transport) revalidate(req *http.Request, reqCc cacheControl, stored storedResponse) (*http.Response, error) {
+	condReq := req.Clone(req.Context())
+	if etag := stored.header.Get("ETag"); etag != "" {
+		condReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := stored.header.Get("Last-Modified"); lastModified != "" {
+		condReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	requestTime := time.Now()
+	resp, err := t.transport().RoundTrip(condReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		resp.Request = req
+		return t.store(req, reqCc, resp, requestTime), nil
+	}
+	resp.Body.Close()
+	// Update the stored response with the new headers, per RFC 9111 section 3.2.
+	for name, values := range resp.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		stored.header[name] = values
+	}
+	stored.requestTime = requestTime
+	stored.responseTime = time.Now()
+	err = t.Cache.TxImmediate(stored.setTags)
+	if errors.Is(err, squirrel.ErrNotFound) {
+		// It was evicted while we were revalidating.
+		return t.fetch(req, reqCc, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.storedResponse(req, stored, stored.responseTime), nil
+}
+
+// Makes the request, and arranges for the response to be stored if permitted. req is what the
+// response is stored for, and sent is what's actually sent.
+func (t *Transport) fetch(req *http.Request, reqCc cacheControl, sent *http.Request) (*http.Response, error) {
+	requestTime := time.Now()
+	resp, err := t.transport().RoundTrip(sent)
+	if err != nil {
+		return nil, err
+	}
+	return t.store(req, reqCc, resp, requestTime), nil
+}
+
+// Returns resp with its body wrapped to store it as it's read, if the response can be stored.
+func (t *Transport) store(req *http.Request, reqCc cacheControl, resp *http.Response, requestTime time.Time) *http.Response {
+	responseTime := time.Now()
+	key, ok := t.storageKey(req, reqCc, resp)
+	if !ok {
+		return resp
+	}
+	header := resp.Header.Clone()
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	stored := storedResponse{
+		key:          key,
+		status:       resp.StatusCode,
+		header:       header,
+		requestTime:  requestTime,
+		responseTime: responseTime,
+	}
+	f, err := os.CreateTemp("", "squirrel-http-cache-")
+	if err != nil {
+		t.logger().Levelf(log.Warning, "not storing response for %v: %v", req.URL, err)
+		return resp
+	}
+	resp.Body = &storingBody{
+		ReadCloser:     resp.Body,
+		t:              t,
+		stored:         stored,
+		expectedLength: resp.ContentLength,
+		file:           f,
+	}
+	return resp
+}
+
+// Returns the key to store the response under, if it may be stored. See RFC 9111 section 3.
+func (t *Transport) storageKey(req *http.Request, reqCc cacheControl, resp *http.Response) (key string, ok bool) {
+	resCc := parseCacheControl(resp.Header)
+	switch {
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusPartialContent, resp.StatusCode == http.StatusNotModified:
+		return
+	case reqCc.has("no-store"), resCc.has("no-store"):
+		return
+	case t.Shared && resCc.has("private"):
+		return
+	case t.Shared && req.Header.Get("Authorization") != "" &&
+		!(resCc.has("public") || resCc.has("s-maxage") || resCc.has("must-revalidate")):
+		return
+	}
+	if !(resCc.has("public") ||
+		(!t.Shared && resCc.has("private")) ||
+		resp.Header.Get("Expires") != "" ||
+		resCc.has("max-age") ||
+		(t.Shared && resCc.has("s-maxage")) ||
+		heuristicallyCacheable[resp.StatusCode]) {
+		return
+	}
+	vary := make(url.Values)
+	for _, line := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return
+			}
+			name = http.CanonicalHeaderKey(name)
+			vary.Set(name, varyValue(req, name))
+		}
+	}
+	return t.urlPrefix(req.URL) + vary.Encode(), true
+}
+
+// Spools a response body to a temporary file as it's read, and stores it when it's complete.
+type storingBody struct {
+	io.ReadCloser
+	t              *Transport
+	stored         storedResponse
+	expectedLength int64
+	file           *os.File
+	written        int64
+}
+
+func (me *storingBody) Read(b []byte) (n int, err error) {
+	n, err = me.ReadCloser.Read(b)
+	if me.file != nil && n > 0 {
+		_, writeErr := me.file.Write(b[:n])
+		if writeErr != nil {
+			me.t.logger().Levelf(log.Warning, "spooling response for %q: %v", me.stored.key, writeErr)
+			me.discard()
+		}
+		me.written += int64(n)
+	}
+	if err == io.EOF && me.file != nil {
+		me.finish()
+	}
+	return
+}
+
+func (me *storingBody) Close() error {
+	me.discard()
+	return me.ReadCloser.Close()
+}
+
+func (me *storingBody) finish() {
+	defer me.discard()
+	if me.expectedLength >= 0 && me.written != me.expectedLength {
+		return
+	}
+	_, err := me.file.Seek(0, io.SeekStart)
+	if err == nil {
+		err = me.t.Cache.PutReader(me.stored.key, me.file, me.written, me.stored.setTags)
+	}
+	if err != nil {
+		me.t.logger().Levelf(log.Warning, "storing response for %q: %v", me.stored.key, err)
+	}
+}
+
+func (me *storingBody) discard() {
+	if me.file == nil {
+		return
+	}
+	me.file.Close()
+	os.Remove(me.file.Name())
+	me.file = nil
+}
+
+// Forwards an unsafe request, and invalidates stored responses for the target URI and any
+// same-origin Location and Content-Location if it succeeds. See RFC 9111 section 4.4.
+func (t *Transport) roundTripUnsafe(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return resp, err
+	}
+	targets := []*url.URL{req.URL}
+	for _, name := range []string{"Location", "Content-Location"} {
+		s := resp.Header.Get(name)
+		if s == "" {
+			continue
+		}
+		u, err := req.URL.Parse(s)
+		if err != nil || u.Scheme != req.URL.Scheme || u.Host != req.URL.Host {
+			continue
+		}
+		targets = append(targets, u)
+	}
+	for _, u := range targets {
+		err := t.invalidate(u)
+		if err != nil {
+			t.logger().Levelf(log.Warning, "invalidating %v: %v", u, err)
+		}
+	}
+	return resp, nil
+}
+
+func (t *Transport) invalidate(u *url.URL) error {
+	var keys []string
+	err := t.Cache.IterKeys(t.urlPrefix(u), func(ki squirrel.KeyInfo) bool {
+		keys = append(keys, ki.Key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return t.Cache.TxImmediate(func(tx *squirrel.Tx) error {
+		for _, key := range keys {
+			err := tx.Delete(key)
+			if err != nil && !errors.Is(err, squirrel.ErrNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+}
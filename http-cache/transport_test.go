@@ -0,0 +1,149 @@
+package httpCache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/squirrel"
+)
+
+type testOrigin struct {
+	hits    atomic.Int64
+	handler func(w http.ResponseWriter, r *http.Request)
+}
+
+func (me *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	me.hits.Add(1)
+	me.handler(w, r)
+}
+
+func newTestClient(c *qt.C, handler func(w http.ResponseWriter, r *http.Request)) (*http.Client, *testOrigin, string) {
+	origin := &testOrigin{handler: handler}
+	server := httptest.NewServer(origin)
+	c.Cleanup(server.Close)
+	cache := squirrel.TestingNewCache(c, squirrel.TestingDefaultCacheOpts(c))
+	return &http.Client{Transport: &Transport{Cache: cache}}, origin, server.URL
+}
+
+func get(c *qt.C, client *http.Client, url string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	c.Assert(err, qt.IsNil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	return resp, string(b)
+}
+
+func TestFreshResponseServedFromCache(t *testing.T) {
+	c := qt.New(t)
+	client, origin, url := newTestClient(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "hello")
+	})
+	for range [2]struct{}{} {
+		resp, body := get(c, client, url+"/a", nil)
+		c.Check(resp.StatusCode, qt.Equals, http.StatusOK)
+		c.Check(body, qt.Equals, "hello")
+	}
+	c.Check(origin.hits.Load(), qt.Equals, int64(1))
+	resp, _ := get(c, client, url+"/a", http.Header{"Cache-Control": {"no-cache"}})
+	c.Check(resp.Header.Get("Age"), qt.Equals, "")
+	c.Check(origin.hits.Load(), qt.Equals, int64(2))
+}
+
+func TestRevalidation(t *testing.T) {
+	c := qt.New(t)
+	client, origin, url := newTestClient(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("X-Revalidated", "yes")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "body")
+	})
+	_, body := get(c, client, url, nil)
+	c.Check(body, qt.Equals, "body")
+	resp, body := get(c, client, url, nil)
+	c.Check(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Check(body, qt.Equals, "body")
+	c.Check(resp.Header.Get("X-Revalidated"), qt.Equals, "yes")
+	c.Check(resp.Header.Get("Age"), qt.Equals, "0")
+	c.Check(origin.hits.Load(), qt.Equals, int64(2))
+}
+
+func TestVary(t *testing.T) {
+	c := qt.New(t)
+	client, origin, url := newTestClient(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, "lang "+r.Header.Get("Accept-Language"))
+	})
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		_, body := get(c, client, url, http.Header{"Accept-Language": {lang}})
+		c.Check(body, qt.Equals, "lang "+lang)
+	}
+	c.Check(origin.hits.Load(), qt.Equals, int64(2))
+}
+
+func TestNotStored(t *testing.T) {
+	c := qt.New(t)
+	client, origin, url := newTestClient(c, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/no-store" {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		io.WriteString(w, "some body")
+	})
+	get(c, client, url+"/no-store", nil)
+	get(c, client, url+"/no-store", nil)
+	c.Check(origin.hits.Load(), qt.Equals, int64(2))
+	// A body that isn't read to the end isn't stored.
+	resp, err := client.Get(url + "/unread")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	get(c, client, url+"/unread", nil)
+	c.Check(origin.hits.Load(), qt.Equals, int64(4))
+	get(c, client, url+"/unread", nil)
+	c.Check(origin.hits.Load(), qt.Equals, int64(4))
+	// Only-if-cached doesn't go to the origin.
+	resp, _ = get(c, client, url+"/no-store", http.Header{"Cache-Control": {"only-if-cached"}})
+	c.Check(resp.StatusCode, qt.Equals, http.StatusGatewayTimeout)
+	c.Check(origin.hits.Load(), qt.Equals, int64(4))
+}
+
+func TestUnsafeMethodInvalidates(t *testing.T) {
+	c := qt.New(t)
+	var version atomic.Int64
+	client, origin, url := newTestClient(c, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			version.Add(1)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, string(rune('a'+version.Load())))
+	})
+	_, body := get(c, client, url, nil)
+	c.Check(body, qt.Equals, "a")
+	_, body = get(c, client, url, nil)
+	c.Check(body, qt.Equals, "a")
+	resp, err := client.Post(url, "text/plain", nil)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	_, body = get(c, client, url, nil)
+	c.Check(body, qt.Equals, "b")
+	c.Check(origin.hits.Load(), qt.Equals, int64(3))
+}
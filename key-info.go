@@ -0,0 +1,173 @@
+package squirrel
+
+import (
+	"errors"
+	"time"
+
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Metadata for a key, as stored in the keys table.
+type KeyInfo struct {
+	Key         string
+	Length      int64
+	CreateTime  time.Time
+	LastUsed    time.Time
+	AccessCount int64
+	// Changes to a higher value each time the key is created or written. Generations are unique
+	// across keys, so a key that's deleted and recreated won't have a generation it had before.
+	Generation int64
+}
+
+const keyInfoColumns = `key, length, create_time, last_used, access_count, generation`
+
+func keyInfoFromStmt(stmt *sqlite.Stmt) KeyInfo {
+	return KeyInfo{
+		Key:         stmt.ColumnText(0),
+		Length:      stmt.ColumnInt64(1),
+		CreateTime:  timeFromStmtColumn(stmt, 2),
+		LastUsed:    timeFromStmtColumn(stmt, 3),
+		AccessCount: stmt.ColumnInt64(4),
+		Generation:  stmt.ColumnInt64(5),
+	}
+}
+
+// Returns the metadata for a key. This does not count as an access.
+func (tx *Tx) Stat(key string) (ret KeyInfo, err error) {
+	ok, err := tx.conn.sqliteQueryRow(
+		`select `+keyInfoColumns+` from keys where key=? and not `+counterExpiredExpr,
+		func(stmt *sqlite.Stmt) error {
+			ret = keyInfoFromStmt(stmt)
+			return nil
+		},
+		key,
+	)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = ErrNotFound
+	}
+	return
+}
+
+// Calls f for each key starting with prefix, in key order, until f returns false. An empty prefix
+// matches all keys.
+func (tx *Tx) IterKeys(prefix string, f func(KeyInfo) (more bool)) error {
+	return tx.conn.iterKeys(prefix, f)
+}
+
+func (conn conn) iterKeys(prefix string, f func(KeyInfo) (more bool)) (err error) {
+	end, ok := prefixEnd(prefix)
+	return conn.iterKeyRange(prefix, end, ok, f)
+}
+
+// Iterates over keys from start (inclusive) to end (exclusive), if endOk.
+func (conn conn) iterKeyRange(start, end string, endOk bool, f func(KeyInfo) (more bool)) (err error) {
+	query := `select ` + keyInfoColumns + ` from keys where key >= ?1 and not ` + counterExpiredExpr
+	args := []any{start}
+	if endOk {
+		query += ` and key < ?2`
+		args = append(args, end)
+	}
+	query += ` order by key`
+	err = conn.sqliteQuery(
+		query,
+		func(stmt *sqlite.Stmt) error {
+			if !f(keyInfoFromStmt(stmt)) {
+				return errStopIteration
+			}
+			return nil
+		},
+		args...,
+	)
+	if err == errStopIteration {
+		err = nil
+	}
+	return
+}
+
+// Returned from statement result callbacks to end iteration early.
+var errStopIteration = errors.New("stop iteration")
+
+// Returns the smallest string that is greater than every string with the given prefix. There is no
+// such string if the prefix is empty or made up entirely of 0xff bytes.
+func prefixEnd(prefix string) (_ string, ok bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return
+}
+
+// Returns the tags for a key. Tag values are int64, float64, string, []byte or nil depending on
+// how they are stored.
+func (tx *Tx) Tags(key string) (tags map[string]any, err error) {
+	cols, err := tx.conn.openKey(key)
+	if err != nil {
+		return
+	}
+	return tx.conn.tagsForKeyId(cols.id)
+}
+
+func (conn conn) tagsForKeyId(keyId rowid) (tags map[string]any, err error) {
+	tags = make(map[string]any)
+	err = conn.sqliteQuery(
+		`select tag_name, typeof(value), value from tags where key_id=?`,
+		func(stmt *sqlite.Stmt) error {
+			tags[stmt.ColumnText(0)] = stmtColumnValue(stmt, 1)
+			return nil
+		},
+		keyId,
+	)
+	return
+}
+
+// Returns the value of the column after the one containing its sqlite typeof. This avoids depending
+// on the column type API which differs between sqlite implementations.
+func stmtColumnValue(stmt *sqlite.Stmt, typeofCol int) any {
+	col := typeofCol + 1
+	switch stmt.ColumnText(typeofCol) {
+	case "integer":
+		return stmt.ColumnInt64(col)
+	case "real":
+		return stmt.ColumnFloat(col)
+	case "text":
+		return stmt.ColumnText(col)
+	case "blob":
+		b := make([]byte, stmt.ColumnLen(col))
+		stmt.ColumnBytes(col, b)
+		return b
+	default:
+		return nil
+	}
+}
+
+// Returns the metadata for a key. This does not count as an access.
+func (c *Cache) Stat(key string) (ret KeyInfo, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		ret, err = tx.Stat(key)
+		return
+	})
+	return
+}
+
+// Calls f for each key starting with prefix, in key order, until f returns false. This occurs in a
+// single read transaction.
+func (c *Cache) IterKeys(prefix string, f func(KeyInfo) (more bool)) error {
+	return c.Tx(func(tx *Tx) error {
+		return tx.IterKeys(prefix, f)
+	})
+}
+
+// Returns all the tags for a key.
+func (c *Cache) Tags(key string) (tags map[string]any, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		tags, err = tx.Tags(key)
+		return
+	})
+	return
+}
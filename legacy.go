@@ -0,0 +1,150 @@
+package squirrel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	g "github.com/anacrolix/generics"
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// Legacy databases, as produced by older anacrolix/torrent sqlite storage, keep values whole in
+// blob_data, named by the blob table. See createBlob and rowidForBlob.
+var errNoLegacyTables = errors.New("database doesn't have legacy blob and blob_data tables")
+
+// Copies the keys from a legacy database at path into the cache, replacing existing keys with the
+// same names. Values are chunked at the cache's maximum blob size, and last used times are kept.
+// It's all done in a single transaction. The legacy database is opened read-only, must already
+// exist, and mustn't be the cache's own database, see ConvertLegacy for that.
+func (c *Cache) ImportLegacy(path string) (imported int, err error) {
+	// SQLite's error for a missing file doesn't say which, and it's an easy mistake to make.
+	_, err = os.Stat(path)
+	if err != nil {
+		return
+	}
+	c.singleWriter.Lock()
+	defer c.singleWriter.Unlock()
+	err = c.withConn(func(conn conn) (err error) {
+		// This can't be done inside a transaction.
+		err = conn.sqliteExec(`attach database ? as legacy`, fmt.Sprintf("file:%s?mode=ro", url.PathEscape(path)))
+		if err != nil {
+			return
+		}
+		defer func() {
+			err = errors.Join(err, conn.sqliteExec(`detach database legacy`))
+		}()
+		return conn.runTx(func(tx *Tx) (err error) {
+			imported, err = tx.importLegacy("legacy")
+			return
+		}, "immediate")
+	})
+	return
+}
+
+// Converts legacy tables in the cache's own database to the current layout in a single
+// transaction, and then drops them. The file doesn't shrink until it's vacuumed.
+func (c *Cache) ConvertLegacy() (imported int, err error) {
+	err = c.TxImmediate(func(tx *Tx) (err error) {
+		imported, err = tx.importLegacy("main")
+		if err != nil {
+			return
+		}
+		// Open blob handles lock the database against schema changes.
+		tx.conn.closeBlobs()
+		err = tx.conn.sqliteExec(`drop table blob`)
+		if err != nil {
+			return
+		}
+		return tx.conn.sqliteExec(`drop table blob_data`)
+	})
+	return
+}
+
+type legacyEntry struct {
+	name     string
+	dataId   rowid
+	length   int64
+	lastUsed g.Option[int64]
+}
+
+func (tx *Tx) importLegacy(schema string) (imported int, err error) {
+	var tables int
+	err = tx.conn.sqliteQuery(
+		fmt.Sprintf(`select count(*) from %s.sqlite_master where type='table' and name in ('blob', 'blob_data')`, schema),
+		func(stmt *sqlite.Stmt) error {
+			tables = stmt.ColumnInt(0)
+			return nil
+		},
+	)
+	if err != nil {
+		return
+	}
+	if tables != 2 {
+		err = errNoLegacyTables
+		return
+	}
+	lastUsedExpr := "null"
+	err = tx.conn.sqliteQuery(
+		fmt.Sprintf(`select 1 from pragma_table_info('blob', '%s') where name='last_used'`, schema),
+		func(stmt *sqlite.Stmt) error {
+			// Legacy last used times are datetime text.
+			lastUsedExpr = `case typeof(last_used) when 'text' then cast(unixepoch(last_used, 'subsec')*1e3 as integer) end`
+			return nil
+		},
+	)
+	if err != nil {
+		return
+	}
+	// Collect the entries first, since we write to the database while copying each one.
+	var entries []legacyEntry
+	err = tx.conn.sqliteQuery(
+		fmt.Sprintf(
+			`select name, data_id, length(data), %s from %s.blob join %s.blob_data using (data_id)
+			where data is not null`,
+			lastUsedExpr, schema, schema,
+		),
+		func(stmt *sqlite.Stmt) error {
+			e := legacyEntry{
+				name:   stmt.ColumnText(0),
+				dataId: stmt.ColumnInt64(1),
+				length: stmt.ColumnInt64(2),
+			}
+			if stmt.ColumnType(3) != sqlite.TypeNull {
+				e.lastUsed.Set(stmt.ColumnInt64(3))
+			}
+			entries = append(entries, e)
+			return nil
+		},
+	)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		err = tx.importLegacyEntry(schema, e)
+		if err != nil {
+			err = fmt.Errorf("importing %q: %w", e.name, err)
+			return
+		}
+		imported++
+	}
+	return
+}
+
+func (tx *Tx) importLegacyEntry(schema string, e legacyEntry) (err error) {
+	blob, err := tx.conn.sqliteConn.OpenBlob(schema, "blob_data", "data", e.dataId, false)
+	if err != nil {
+		return
+	}
+	keyId, err := tx.putReader(e.name, io.NewSectionReader(blob, 0, e.length), e.length)
+	err = errors.Join(err, blob.Close())
+	if err != nil || !e.lastUsed.Ok {
+		return
+	}
+	err = tx.conn.sqliteExec(`update keys set last_used=? where key_id=?`, e.lastUsed.Value, keyId)
+	// Writing the value counted as an access, which would clobber the time we just restored.
+	delete(tx.accessedKeys, keyId)
+	return
+}
@@ -0,0 +1,178 @@
+package squirrel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	sqlite "github.com/go-llsqlite/adapter"
+	"github.com/go-llsqlite/adapter/sqlitex"
+)
+
+// Cached load errors are kept in their own table, outside the key namespace, so they aren't seen by
+// anything enumerating keys, and don't count toward capacity. Expired errors are deleted when
+// another is stored.
+func addLoadErrorsTable(conn sqliteConn) (err error) {
+	err = sqlitex.ExecScript(conn, `
+		create table if not exists load_errors (
+			key text primary key,
+			msg text not null,
+			expires integer not null
+		) strict, without rowid;
+		-- Load errors were briefly stored as keys under this prefix.
+		delete from keys where key >= 'squirrel.load-error/' and key < 'squirrel.load-error0';
+	`)
+	return
+}
+
+// Produces the value for a key in GetOrLoad. length is -1 if it isn't known, in which case the value
+// is spooled to a temporary file before it's stored. r is closed by GetOrLoad.
+type Loader func(ctx context.Context) (r io.ReadCloser, length int64, err error)
+
+type LoadOpts struct {
+	// If positive, an error from the Loader is stored, and returned by GetOrLoad as a
+	// *CachedLoadError until it expires, instead of calling the Loader again. Context errors aren't
+	// stored.
+	NegativeTTL time.Duration
+}
+
+// Returned by GetOrLoad when a previous load failed and the failure was cached. Only the message of
+// the original error is kept.
+type CachedLoadError struct {
+	Key     string
+	Msg     string
+	Expires time.Time
+}
+
+func (e *CachedLoadError) Error() string {
+	return fmt.Sprintf("cached error loading %q: %v", e.Key, e.Msg)
+}
+
+// Returns the value for key, calling loader to produce and store it if it's missing. Concurrent
+// callers missing on the same key share a single call to loader. Its context carries the values of
+// the first caller's, but isn't cancelled when that caller gives up, so loader should apply its own
+// timeout. Callers stop waiting when their own context is done.
+func (c *Cache) GetOrLoad(ctx context.Context, key string, loader Loader) ([]byte, error) {
+	return c.GetOrLoadWithOpts(ctx, key, loader, LoadOpts{})
+}
+
+// See GetOrLoad.
+func (c *Cache) GetOrLoadWithOpts(ctx context.Context, key string, loader Loader, opts LoadOpts) ([]byte, error) {
+	b, err := c.getLoaded(key)
+	if !errors.Is(err, ErrNotFound) {
+		return b, err
+	}
+	ch := c.loads.DoChan(key, func() (any, error) {
+		// Someone else may have finished loading between our miss and getting here.
+		b, err := c.getLoaded(key)
+		if !errors.Is(err, ErrNotFound) {
+			return b, err
+		}
+		return c.load(detachedContext{ctx}, key, loader, opts)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		b, _ := res.Val.([]byte)
+		if res.Shared && b != nil {
+			// Each caller gets its own copy to do with as it pleases.
+			b = append([]byte(nil), b...)
+		}
+		return b, res.Err
+	}
+}
+
+// Returns the value, a *CachedLoadError, or ErrNotFound if there's nothing usable stored.
+func (c *Cache) getLoaded(key string) (b []byte, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		b, err = tx.ReadAll(key, nil)
+		if !errors.Is(err, ErrNotFound) {
+			return
+		}
+		err = ErrNotFound
+		queryErr := tx.conn.sqliteQueryMaxOneRow(
+			sqlQuery(`select msg, expires from load_errors where key=? and expires>?`),
+			func(stmt *sqlite.Stmt) error {
+				err = &CachedLoadError{
+					Key:     key,
+					Msg:     stmt.ColumnText(0),
+					Expires: time.UnixMilli(stmt.ColumnInt64(1)),
+				}
+				return nil
+			},
+			key, time.Now().UnixMilli(),
+		)
+		if queryErr != nil {
+			err = queryErr
+		}
+		return
+	})
+	return
+}
+
+func (c *Cache) load(ctx context.Context, key string, loader Loader, opts LoadOpts) (b []byte, err error) {
+	r, length, err := loader(ctx)
+	if err != nil {
+		if opts.NegativeTTL > 0 && !isContextError(err) {
+			err = errors.Join(err, c.storeLoadError(key, err, time.Now().Add(opts.NegativeTTL)))
+		}
+		return
+	}
+	defer r.Close()
+	// Read it back in the same transaction so it can't be evicted before we return it.
+	err = c.PutReader(key, r, length, func(tx *Tx) (err error) {
+		err = tx.conn.sqliteQuery(sqlQuery(`delete from load_errors where key=?`), nil, key)
+		if err != nil {
+			return
+		}
+		b, err = tx.ReadAll(key, nil)
+		return
+	})
+	return
+}
+
+func (c *Cache) storeLoadError(key string, loadErr error, expires time.Time) error {
+	return c.TxImmediate(func(tx *Tx) (err error) {
+		err = tx.conn.sqliteQuery(
+			sqlQuery(`delete from load_errors where expires<=?`), nil, time.Now().UnixMilli())
+		if err != nil {
+			return
+		}
+		return tx.conn.sqliteQuery(
+			sqlQuery(`insert or replace into load_errors (key, msg, expires) values (?, ?, ?)`),
+			nil,
+			key, loadErr.Error(), expires.UnixMilli(),
+		)
+	})
+}
+
+// Context errors say more about the caller than the thing being loaded.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Keeps the values of a Context, but not its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+var _ context.Context = detachedContext{}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (me detachedContext) Value(key any) any {
+	return me.parent.Value(key)
+}
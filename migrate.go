@@ -0,0 +1,133 @@
+package squirrel
+
+import (
+	"fmt"
+
+	sqlite "github.com/go-llsqlite/adapter"
+	"github.com/go-llsqlite/adapter/sqlitex"
+)
+
+type migration struct {
+	name  string
+	apply func(conn sqliteConn) error
+}
+
+// Schema changes, in order. The schema version recorded in pragma user_version is the number of
+// migrations applied. Databases from before versioning have version 0, but may already have some of
+// the changes, so migrations must tolerate that. Only append to this.
+var migrations = []migration{
+	{"initial schema", func(conn sqliteConn) error {
+		return sqlitex.ExecScript(conn, initScript)
+	}},
+	{"key generations", addGenerationColumn},
+	{"load errors table", addLoadErrorsTable},
+	{"counter expiry column", addExpiresColumn},
+}
+
+// Returns the schema version this package creates and understands.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// Returned when opening a database with a schema version from a newer version of this package.
+type ErrSchemaTooNew struct {
+	Version int
+}
+
+func (me ErrSchemaTooNew) Error() string {
+	return fmt.Sprintf("schema version %v is newer than supported version %v", me.Version, LatestSchemaVersion())
+}
+
+// Returned when opening a database that needs migrating with InitDbOpts.DontInitSchema, which
+// prevents migrations being applied.
+type ErrSchemaTooOld struct {
+	Version int
+}
+
+func (me ErrSchemaTooOld) Error() string {
+	return fmt.Sprintf(
+		"schema version %v is older than version %v and must be migrated first",
+		me.Version, LatestSchemaVersion(),
+	)
+}
+
+// Returns the schema version of the database.
+func GetSchemaVersion(conn sqliteConn) (version int, err error) {
+	err = sqlitex.ExecTransient(conn, "pragma user_version", func(stmt *sqlite.Stmt) error {
+		version = stmt.ColumnInt(0)
+		return nil
+	})
+	return
+}
+
+// Returns the names of the migrations that Migrate would apply.
+func PendingMigrations(conn sqliteConn) (names []string, err error) {
+	version, err := GetSchemaVersion(conn)
+	if err != nil {
+		return
+	}
+	if version > LatestSchemaVersion() {
+		err = ErrSchemaTooNew{version}
+		return
+	}
+	for _, m := range migrations[version:] {
+		names = append(names, m.name)
+	}
+	return
+}
+
+// Brings the schema up to date in a single transaction, returning the names of the migrations
+// applied. It's an ErrSchemaTooNew if the database is from a newer version.
+func Migrate(conn sqliteConn) (applied []string, err error) {
+	err = sqlitex.WithTransactionRollbackOnError(conn, `immediate`, func() (err error) {
+		applied, err = migrate(conn)
+		return
+	})
+	if err != nil {
+		applied = nil
+	}
+	return
+}
+
+// Applies pending migrations in the current transaction.
+func migrate(conn sqliteConn) (applied []string, err error) {
+	version, err := GetSchemaVersion(conn)
+	if err != nil {
+		return
+	}
+	if version > LatestSchemaVersion() {
+		err = ErrSchemaTooNew{version}
+		return
+	}
+	for ; version < LatestSchemaVersion(); version++ {
+		m := migrations[version]
+		err = m.apply(conn)
+		if err != nil {
+			err = fmt.Errorf("applying migration %v (%v): %w", version+1, m.name, err)
+			return
+		}
+		applied = append(applied, m.name)
+	}
+	if len(applied) == 0 {
+		return
+	}
+	// Pragmas can't take parameters.
+	err = sqlitex.ExecTransient(conn, fmt.Sprintf("pragma user_version=%d", version), nil)
+	return
+}
+
+// Fails unless the database is at the latest version. Used when the schema isn't being initialized,
+// so it can't be migrated.
+func checkSchemaVersion(conn sqliteConn) error {
+	version, err := GetSchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return ErrSchemaTooNew{version}
+	}
+	if version < LatestSchemaVersion() {
+		return ErrSchemaTooOld{version}
+	}
+	return nil
+}
@@ -1,9 +1,16 @@
 package squirrel
 
 import (
+	"bytes"
+	"fmt"
 	squirrelTesting "github.com/anacrolix/squirrel/internal/testing"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/anacrolix/log"
 	qt "github.com/frankban/quicktest"
@@ -78,3 +85,283 @@ func TestSeekingBlobBtree(t *testing.T) {
 	it.Last()
 	qtc.Assert(it.Cur(), qt.Equals, valueKey{1, 1})
 }
+
+func TestCheckAndRepair(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	opts.MaxBlobSize.Set(2)
+	cache := TestingNewCache(qtc, opts)
+	for _, key := range []string{"gap", "missing", "ok", "overlap"} {
+		qtc.Assert(cache.Put(key, []byte("abcdef")), qt.IsNil)
+	}
+	problems, err := cache.Check()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(problems, qt.HasLen, 0)
+	// Corrupt the database behind squirrel's back, without foreign keys enforced.
+	conn, err := newSqliteConn(opts.NewConnOpts)
+	qtc.Assert(err, qt.IsNil)
+	defer conn.Close()
+	for _, query := range []string{
+		`delete from "values" where value_id=(select key_id from keys where key='gap') and offset=2`,
+		`delete from blobs where blob_id=(
+			select blob_id from "values" join keys on value_id=key_id where key='missing' and offset=0)`,
+		`update "values" set offset=1 where value_id=(select key_id from keys where key='overlap') and offset=2`,
+		`insert into tags values (999, 'x', 1)`,
+		`insert into "values" values (999, 0, 12345)`,
+	} {
+		qtc.Assert(sqlitex.Exec(conn, query, nil), qt.IsNil)
+	}
+	kinds := func(problems []CheckProblem) (ret []CheckProblemKind) {
+		for _, p := range problems {
+			ret = append(ret, p.Kind)
+		}
+		return
+	}
+	problems, err = cache.Check()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(kinds(problems), qt.DeepEquals, []CheckProblemKind{
+		CheckProblemOrphanValue,
+		CheckProblemOrphanBlob,
+		CheckProblemOrphanTag,
+		CheckProblemBadCoverage,
+		CheckProblemMissingBlob,
+		CheckProblemBadCoverage,
+	})
+	for _, p := range problems {
+		qtc.Check(p.Repair, qt.Equals, "")
+	}
+	problems, err = cache.Repair()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(problems, qt.HasLen, 6)
+	for _, p := range problems {
+		qtc.Check(p.Repair, qt.Not(qt.Equals), "")
+	}
+	problems, err = cache.Check()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(problems, qt.HasLen, 0)
+	value, err := cache.ReadAll("gap", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "ab")
+	_, err = cache.ReadAll("missing", nil)
+	qtc.Check(err, qt.ErrorIs, ErrNotFound)
+	value, err = cache.ReadAll("ok", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "abcdef")
+	value, err = cache.ReadAll("overlap", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "ab")
+
+	// Make an index disagree with its table, which only sqlite could fix.
+	for _, query := range []string{
+		`create table junk (x)`,
+		`create index junk_x on junk (x)`,
+		`insert into junk values (1), (2)`,
+		`pragma writable_schema=on`,
+		`update sqlite_master set sql='create index junk_x on junk (x desc)' where name='junk_x'`,
+		`pragma writable_schema=off`,
+	} {
+		qtc.Assert(sqlitex.Exec(conn, query, nil), qt.IsNil)
+	}
+	problems, err = cache.Repair()
+	qtc.Check(err, qt.ErrorMatches, `integrity check still fails after repair: .*junk_x.*`)
+	qtc.Assert(problems, qt.Not(qt.HasLen), 0)
+	for _, p := range problems {
+		qtc.Check(p.Kind, qt.Equals, CheckProblemIntegrity)
+	}
+}
+
+func TestMigrateUnversionedDatabase(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	// A cache from before versioning, with a key but no generations.
+	conn, err := newSqliteConn(opts.NewConnOpts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(sqlitex.ExecScript(conn, initScript), qt.IsNil)
+	qtc.Assert(sqlitex.Exec(conn, `insert into keys (key, length) values ('old', 0)`, nil), qt.IsNil)
+	pending, err := PendingMigrations(conn)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(pending, qt.HasLen, LatestSchemaVersion())
+	qtc.Assert(conn.Close(), qt.IsNil)
+
+	// Without initializing the schema, it can't be migrated, so it's refused.
+	dontInitOpts := opts
+	dontInitOpts.DontInitSchema = true
+	_, err = NewCache(dontInitOpts)
+	qtc.Check(err, qt.ErrorAs, new(ErrSchemaTooOld))
+
+	cache, err := NewCache(opts)
+	qtc.Assert(err, qt.IsNil)
+	ki, err := cache.Stat("old")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ki.Generation, qt.Equals, int64(0))
+	qtc.Assert(cache.Put("new", nil), qt.IsNil)
+	ki, err = cache.Stat("new")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ki.Generation, qt.Not(qt.Equals), int64(0))
+	qtc.Assert(cache.Close(), qt.IsNil)
+
+	conn, err = newSqliteConn(opts.NewConnOpts)
+	qtc.Assert(err, qt.IsNil)
+	defer conn.Close()
+	version, err := GetSchemaVersion(conn)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(version, qt.Equals, LatestSchemaVersion())
+	applied, err := Migrate(conn)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(applied, qt.HasLen, 0)
+	cache, err = NewCache(dontInitOpts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(cache.Close(), qt.IsNil)
+
+	// Databases from the future are refused.
+	qtc.Assert(sqlitex.ExecTransient(conn, fmt.Sprintf("pragma user_version=%d", LatestSchemaVersion()+1), nil), qt.IsNil)
+	_, err = NewCache(opts)
+	qtc.Check(err, qt.ErrorAs, new(ErrSchemaTooNew))
+}
+
+const legacyTestSchema = `
+create table blob (
+	name text primary key,
+	last_used timestamp default (datetime('now')),
+	data_id integer not null
+);
+create table blob_data (data_id integer primary key, data blob not null);
+`
+
+func writeLegacyTestBlobs(qtc *qt.C, conn sqliteConn) {
+	qtc.Assert(sqlitex.ExecScript(conn, legacyTestSchema), qt.IsNil)
+	for name, value := range map[string]string{"a": "hello world", "b": ""} {
+		rowid, err := createBlob(conn, name, int64(len(value)), false)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Assert(sqlitex.Exec(conn, `update blob_data set data=? where data_id=?`, nil, []byte(value), rowid), qt.IsNil)
+	}
+	qtc.Assert(sqlitex.Exec(conn, `update blob set last_used='2001-02-03 04:05:06' where name='a'`, nil), qt.IsNil)
+}
+
+func checkLegacyTestBlobs(qtc *qt.C, cache *Cache) {
+	value, err := cache.ReadAll("a", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "hello world")
+	ki, err := cache.Stat("a")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ki.LastUsed.UTC().Format(time.DateTime), qt.Equals, "2001-02-03 04:05:06")
+	value, err = cache.ReadAll("b", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.HasLen, 0)
+}
+
+func TestImportLegacy(t *testing.T) {
+	qtc := qt.New(t)
+	legacyPath := TestingTempCachePath(t)
+	conn, err := newSqliteConn(NewConnOpts{Path: legacyPath})
+	qtc.Assert(err, qt.IsNil)
+	writeLegacyTestBlobs(qtc, conn)
+	qtc.Assert(conn.Close(), qt.IsNil)
+
+	opts := TestingDefaultCacheOpts(qtc)
+	// Make the values span multiple blobs.
+	opts.MaxBlobSize.Set(4)
+	cache := TestingNewCache(qtc, opts)
+	imported, err := cache.ImportLegacy(legacyPath)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(imported, qt.Equals, 2)
+	checkLegacyTestBlobs(qtc, cache)
+	emptyPath := TestingTempCachePath(t)
+	conn, err = newSqliteConn(NewConnOpts{Path: emptyPath})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(conn.Close(), qt.IsNil)
+	_, err = cache.ImportLegacy(emptyPath)
+	qtc.Check(err, qt.ErrorIs, errNoLegacyTables)
+	// A mistyped path isn't created as an empty database.
+	missingPath := filepath.Join(t.TempDir(), "missing.db")
+	_, err = cache.ImportLegacy(missingPath)
+	qtc.Check(err, qt.ErrorIs, fs.ErrNotExist)
+	_, err = os.Stat(missingPath)
+	qtc.Check(err, qt.ErrorIs, fs.ErrNotExist)
+}
+
+func TestConvertLegacy(t *testing.T) {
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	conn, err := newSqliteConn(opts.NewConnOpts)
+	qtc.Assert(err, qt.IsNil)
+	writeLegacyTestBlobs(qtc, conn)
+	qtc.Assert(conn.Close(), qt.IsNil)
+
+	cache := TestingNewCache(qtc, opts)
+	imported, err := cache.ConvertLegacy()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(imported, qt.Equals, 2)
+	checkLegacyTestBlobs(qtc, cache)
+	_, err = cache.ConvertLegacy()
+	qtc.Check(err, qt.ErrorIs, errNoLegacyTables)
+}
+
+// Reads under capacity mustn't need the write lock, such as to vacuum free pages.
+func TestFileSizeCapacityReadWhileWriting(t *testing.T) {
+	for _, autoVacuum := range []string{"incremental", "none"} {
+		t.Run(autoVacuum, func(t *testing.T) {
+			qtc := qt.New(t)
+			opts := TestingDefaultCacheOpts(qtc)
+			opts.SetJournalMode = "wal"
+			opts.SetAutoVacuum.Set(autoVacuum)
+			opts.CapacityMode = CapacityFileSize
+			opts.Capacity = 1 << 30
+			cache := TestingNewCache(qtc, opts)
+			value := bytes.Repeat([]byte("squirrel"), 1000)
+			for i := range [10]struct{}{} {
+				qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil)
+			}
+			for i := range [5]struct{}{} {
+				qtc.Assert(cache.Delete(fmt.Sprint(i)), qt.IsNil)
+			}
+			writer, err := newSqliteConn(opts.NewConnOpts)
+			qtc.Assert(err, qt.IsNil)
+			defer writer.Close()
+			qtc.Assert(sqlitex.Exec(writer, "begin immediate", nil), qt.IsNil)
+			defer sqlitex.Exec(writer, "rollback", nil)
+			b, err := cache.ReadAll("9", nil)
+			qtc.Assert(err, qt.IsNil)
+			qtc.Check(b, qt.DeepEquals, value)
+		})
+	}
+}
+
+func TestVolumeCapacity(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("volume capacity requires statfs")
+	}
+	qtc := qt.New(t)
+	opts := TestingDefaultCacheOpts(qtc)
+	total, avail, err := statfs(filepath.Dir(opts.Path))
+	qtc.Assert(err, qt.IsNil)
+	const limit = 256 << 10
+	opts.VolumeCapacity.MaxFraction = float64(limit) / float64(total)
+	cache := TestingNewCache(qtc, opts)
+	value := bytes.Repeat([]byte("squirrel"), 1000)
+	for i := range [100]struct{}{} {
+		qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil)
+	}
+	usage, err := cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(usage.BytesUsed <= limit, qt.IsTrue)
+	qtc.Check(usage.Keys < 100, qt.IsTrue)
+	capacity, ok, err := cache.EffectiveCapacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ok, qt.IsTrue)
+	qtc.Check(capacity <= limit, qt.IsTrue)
+	// A stored capacity applies when it's lower.
+	qtc.Assert(cache.SetCapacity(limit/2), qt.IsNil)
+	capacity, _, err = cache.EffectiveCapacity()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(capacity, qt.Equals, int64(limit/2))
+
+	// Demanding more free space than there is evicts everything that can be, but the cache is still
+	// usable.
+	opts.VolumeCapacity = VolumeCapacity{MinFree: avail + limit}
+	other := TestingNewCache(qtc, opts)
+	qtc.Assert(other.Put("after", value), qt.IsNil)
+	usage, err = other.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(usage.Keys, qt.Equals, int64(0))
+}
@@ -1,16 +1,23 @@
 package squirrel_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	squirrelTesting "github.com/anacrolix/squirrel/internal/testing"
 	"io"
 	"log"
+	"math"
 	"math/rand"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	_ "github.com/anacrolix/envpprof"
+	g "github.com/anacrolix/generics"
 	qt "github.com/frankban/quicktest"
 	sqlite "github.com/go-llsqlite/adapter"
 	"golang.org/x/sync/errgroup"
@@ -248,6 +255,31 @@ func TestIterBlobsWithHigherCachedBlobs(t *testing.T) {
 	qtc.Assert(n, qt.Equals, 2)
 }
 
+func TestPutEmpty(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.Put(defaultKey, nil), qt.IsNil)
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.HasLen, 0)
+}
+
+func TestReadAllAcrossBlobs(t *testing.T) {
+	qtc := qt.New(t)
+	cacheOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	cacheOpts.MaxBlobSize.Set(3)
+	cache := squirrel.TestingNewCache(qtc, cacheOpts)
+	const value = "hello world"
+	qtc.Assert(cache.Put(defaultKey, []byte(value)), qt.IsNil)
+	b, err := cache.ReadAll(defaultKey, nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, value)
+	b = make([]byte, len(value))
+	n, err := cache.ReadFull(defaultKey, b)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b[:n]), qt.Equals, value)
+}
+
 func TestCreateChangeSize(t *testing.T) {
 	qtc := qt.New(t)
 	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
@@ -276,3 +308,708 @@ func TestCreateChangeSize(t *testing.T) {
 	qtc.Check(err, qt.IsNil)
 	qtc.Check(string(value), qt.Equals, "mundo")
 }
+
+func TestIterKeysPrefix(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	for _, key := range []string{"a", "a/b", "a/c", "b", "a\xff", "a\xff\xff"} {
+		qtc.Assert(cache.Put(key, []byte(key)), qt.IsNil)
+	}
+	listKeys := func(prefix string) (keys []string) {
+		err := cache.IterKeys(prefix, func(ki squirrel.KeyInfo) bool {
+			qtc.Check(ki.Length, qt.Equals, int64(len(ki.Key)))
+			keys = append(keys, ki.Key)
+			return true
+		})
+		qtc.Assert(err, qt.IsNil)
+		return
+	}
+	qtc.Check(listKeys(""), qt.DeepEquals, []string{"a", "a/b", "a/c", "a\xff", "a\xff\xff", "b"})
+	qtc.Check(listKeys("a/"), qt.DeepEquals, []string{"a/b", "a/c"})
+	qtc.Check(listKeys("a\xff"), qt.DeepEquals, []string{"a\xff", "a\xff\xff"})
+	qtc.Check(listKeys("c"), qt.IsNil)
+	qtc.Assert(cache.Delete("a/b"), qt.IsNil)
+	qtc.Check(cache.Delete("a/b"), qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Check(listKeys("a/"), qt.DeepEquals, []string{"a/c"})
+}
+
+func TestStatAndTags(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	_, err := cache.Stat(defaultKey)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Assert(cache.Put(defaultKey, defaultValue), qt.IsNil)
+	qtc.Assert(cache.SetTag(defaultKey, "int", 42), qt.IsNil)
+	qtc.Assert(cache.SetTag(defaultKey, "text", "yes"), qt.IsNil)
+	qtc.Assert(cache.SetTag(defaultKey, "blob", []byte{1, 2}), qt.IsNil)
+	ki, err := cache.Stat(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ki.Key, qt.Equals, defaultKey)
+	qtc.Check(ki.Length, qt.Equals, int64(len(defaultValue)))
+	qtc.Check(ki.LastUsed.Before(ki.CreateTime), qt.IsFalse)
+	tags, err := cache.Tags(defaultKey)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(tags, qt.DeepEquals, map[string]any{
+		"int":  int64(42),
+		"text": "yes",
+		"blob": []byte{1, 2},
+	})
+}
+
+func TestCapacityAdministration(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	_, ok := cache.GetCapacity()
+	qtc.Check(ok, qt.IsFalse)
+	value := make([]byte, 1<<16)
+	for _, key := range []string{"a", "b", "c"} {
+		qtc.Assert(cache.Put(key, value), qt.IsNil)
+	}
+	usage, err := cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(usage.Keys, qt.Equals, int64(3))
+	qtc.Check(usage.ValueBytes, qt.Equals, int64(3<<16))
+	qtc.Check(usage.BytesUsed > usage.ValueBytes, qt.IsTrue)
+	// Drop the least recently used key.
+	qtc.Assert(cache.SetCapacity(usage.BytesUsed-1), qt.IsNil)
+	capacity, ok := cache.GetCapacity()
+	qtc.Check(ok, qt.IsTrue)
+	qtc.Check(capacity, qt.Equals, usage.BytesUsed-1)
+	_, err = cache.Stat("a")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Assert(cache.UnlimitCapacity(), qt.IsNil)
+	_, ok = cache.GetCapacity()
+	qtc.Check(ok, qt.IsFalse)
+	evicted, err := cache.TrimTo(0)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(evicted, qt.Equals, 2)
+	usage, err = cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(usage.Keys, qt.Equals, int64(0))
+}
+
+func TestExportImport(t *testing.T) {
+	qtc := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	opts.MaxBlobSize.Set(3)
+	src := squirrel.TestingNewCache(qtc, opts)
+	qtc.Assert(src.Put("a", []byte("hello world")), qt.IsNil)
+	qtc.Assert(src.Put("b/c", nil), qt.IsNil)
+	qtc.Assert(src.SetTag("a", "int", 1), qt.IsNil)
+	qtc.Assert(src.SetTag("a", "a=b", "c"), qt.IsNil)
+	_, err := src.ReadAll("a", nil)
+	qtc.Assert(err, qt.IsNil)
+	_, err = src.IncrWithOpts("expired", 1, squirrel.IncrOpts{TTL: time.Millisecond})
+	qtc.Assert(err, qt.IsNil)
+	time.Sleep(2 * time.Millisecond)
+	var buf bytes.Buffer
+	qtc.Assert(src.Export(&buf), qt.IsNil)
+
+	dst := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(dst.Put("a", []byte("clobbered")), qt.IsNil)
+	qtc.Assert(dst.SetTag("a", "stale", 1), qt.IsNil)
+	qtc.Assert(dst.Import(&buf), qt.IsNil)
+	for _, key := range []string{"a", "b/c"} {
+		srcInfo, err := src.Stat(key)
+		qtc.Assert(err, qt.IsNil)
+		dstInfo, err := dst.Stat(key)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(dstInfo.Length, qt.Equals, srcInfo.Length)
+		qtc.Check(dstInfo.CreateTime.Equal(srcInfo.CreateTime), qt.IsTrue)
+		qtc.Check(dstInfo.LastUsed.Equal(srcInfo.LastUsed), qt.IsTrue)
+		qtc.Check(dstInfo.AccessCount, qt.Equals, srcInfo.AccessCount)
+		srcTags, err := src.Tags(key)
+		qtc.Assert(err, qt.IsNil)
+		dstTags, err := dst.Tags(key)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(dstTags, qt.DeepEquals, srcTags)
+	}
+	value, err := dst.ReadAll("a", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "hello world")
+	// Counter expiry is carried over.
+	_, err = dst.GetCounter("expired")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+}
+
+func TestGetOrLoad(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	ctx := context.Background()
+	var calls atomic.Int64
+	release := make(chan struct{})
+	loader := func(ctx context.Context) (io.ReadCloser, int64, error) {
+		calls.Add(1)
+		<-release
+		return io.NopCloser(strings.NewReader("loaded")), -1, nil
+	}
+	var eg errgroup.Group
+	for range [10]struct{}{} {
+		eg.Go(func() error {
+			b, err := cache.GetOrLoad(ctx, "k", loader)
+			if err == nil && string(b) != "loaded" {
+				err = fmt.Errorf("got %q", b)
+			}
+			return err
+		})
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	qtc.Assert(eg.Wait(), qt.IsNil)
+	qtc.Check(calls.Load(), qt.Equals, int64(1))
+	b, err := cache.GetOrLoad(ctx, "k", loader)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "loaded")
+	qtc.Check(calls.Load(), qt.Equals, int64(1))
+
+	// Errors aren't cached unless asked for.
+	loadErr := errors.New("upstream down")
+	failing := func(ctx context.Context) (io.ReadCloser, int64, error) {
+		calls.Add(1)
+		return nil, 0, loadErr
+	}
+	calls.Store(0)
+	_, err = cache.GetOrLoad(ctx, "bad", failing)
+	qtc.Check(err, qt.ErrorIs, loadErr)
+	_, err = cache.GetOrLoad(ctx, "bad", failing)
+	qtc.Check(err, qt.ErrorIs, loadErr)
+	qtc.Check(calls.Load(), qt.Equals, int64(2))
+	opts := squirrel.LoadOpts{NegativeTTL: time.Hour}
+	_, err = cache.GetOrLoadWithOpts(ctx, "bad", failing, opts)
+	qtc.Check(err, qt.ErrorIs, loadErr)
+	_, err = cache.GetOrLoadWithOpts(ctx, "bad", failing, opts)
+	var cached *squirrel.CachedLoadError
+	qtc.Assert(errors.As(err, &cached), qt.IsTrue)
+	qtc.Check(cached.Msg, qt.Equals, "upstream down")
+	qtc.Check(calls.Load(), qt.Equals, int64(3))
+	// The cached error isn't a value, or a key.
+	_, err = cache.ReadAll("bad", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	var keys []string
+	qtc.Assert(cache.IterKeys("", func(ki squirrel.KeyInfo) bool {
+		keys = append(keys, ki.Key)
+		return true
+	}), qt.IsNil)
+	qtc.Check(keys, qt.DeepEquals, []string{"k"})
+	// Context errors aren't cached.
+	timingOut := func(ctx context.Context) (io.ReadCloser, int64, error) {
+		calls.Add(1)
+		return nil, 0, context.DeadlineExceeded
+	}
+	calls.Store(0)
+	for range [2]struct{}{} {
+		_, err = cache.GetOrLoadWithOpts(ctx, "slow", timingOut, opts)
+		qtc.Check(err, qt.ErrorIs, context.DeadlineExceeded)
+	}
+	qtc.Check(calls.Load(), qt.Equals, int64(2))
+	// A successful load replaces the cached error once it expires.
+	_, err = cache.GetOrLoadWithOpts(ctx, "bad2", failing, squirrel.LoadOpts{NegativeTTL: time.Millisecond})
+	qtc.Check(err, qt.ErrorIs, loadErr)
+	time.Sleep(2 * time.Millisecond)
+	b, err = cache.GetOrLoad(ctx, "bad2", func(ctx context.Context) (io.ReadCloser, int64, error) {
+		return io.NopCloser(strings.NewReader("ok")), 2, nil
+	})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "ok")
+	tags, err := cache.Tags("bad2")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(tags, qt.HasLen, 0)
+}
+
+func TestGetOrLoadFirstCallerGivesUp(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loader := func(ctx context.Context) (io.ReadCloser, int64, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-release:
+		}
+		return io.NopCloser(strings.NewReader("loaded")), -1, nil
+	}
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := cache.GetOrLoad(firstCtx, "k", loader)
+		firstErr <- err
+	}()
+	<-started
+	second := make(chan []byte, 1)
+	go func() {
+		b, _ := cache.GetOrLoad(context.Background(), "k", loader)
+		second <- b
+	}()
+	cancel()
+	qtc.Check(<-firstErr, qt.ErrorIs, context.Canceled)
+	// The shared load carries on for the caller still waiting.
+	close(release)
+	qtc.Check(string(<-second), qt.Equals, "loaded")
+}
+
+func TestTyped(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	type point struct {
+		X, Y int
+	}
+	pointKey := func(id int) string {
+		return fmt.Sprintf("point/%d", id)
+	}
+	for _, codec := range []squirrel.Codec[point]{squirrel.GobCodec[point]{}, squirrel.JSONCodec[point]{}} {
+		points := squirrel.NewTyped[int, point](cache, pointKey, codec)
+		_, err := points.Get(1)
+		qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+		qtc.Assert(points.Put(1, point{1, 2}), qt.IsNil)
+		p, err := points.Get(1)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(p, qt.Equals, point{1, 2})
+		qtc.Assert(points.Delete(1), qt.IsNil)
+		p, err = points.GetOrLoad(context.Background(), 2, func(context.Context) (point, error) {
+			return point{3, 4}, nil
+		})
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(p, qt.Equals, point{3, 4})
+		p, err = points.Get(2)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(p, qt.Equals, point{3, 4})
+		qtc.Assert(points.Delete(2), qt.IsNil)
+	}
+	times := squirrel.NewTyped[string, time.Time](cache, squirrel.StringKey[string], squirrel.BinaryCodec[time.Time, *time.Time]{})
+	now := time.Now()
+	qtc.Assert(times.Put("now", now), qt.IsNil)
+	got, err := times.Get("now")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(got.Equal(now), qt.IsTrue)
+	raw := squirrel.NewTyped[string, []byte](cache, squirrel.StringKey[string], squirrel.BytesCodec{})
+	b, err := raw.Get("now")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, must(now.MarshalBinary()))
+}
+
+func must[T any](t T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestPutManyGetMany(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	var items []squirrel.KeyValue
+	for i := 0; i < 1000; i++ {
+		items = append(items, squirrel.KeyValue{
+			Key:   fmt.Sprintf("item/%d", i),
+			Value: []byte(strings.Repeat("x", i%7)),
+		})
+	}
+	errs, err := cache.PutMany(items)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(errs, qt.HasLen, len(items))
+	for _, err := range errs {
+		qtc.Assert(err, qt.IsNil)
+	}
+	results, err := cache.GetMany([]string{"item/3", "missing", "item/999"})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(results, qt.HasLen, 3)
+	qtc.Check(string(results[0].Value), qt.Equals, "xxx")
+	qtc.Check(results[0].Err, qt.IsNil)
+	qtc.Check(results[1].Err, qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Check(string(results[2].Value), qt.Equals, "xxxxx")
+	usage, err := cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(usage.Keys, qt.Equals, int64(len(items)))
+}
+
+func TestConditionalWrites(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	qtc.Assert(cache.PutIf("k", []byte("a"), squirrel.IfAbsent()), qt.IsNil)
+	qtc.Check(cache.PutIf("k", []byte("b"), squirrel.IfAbsent()), qt.ErrorIs, squirrel.ErrPreconditionFailed)
+	info, err := cache.Stat("k")
+	qtc.Assert(err, qt.IsNil)
+	gen1 := info.Generation
+	qtc.Assert(cache.PutIf("k", []byte("b"), squirrel.IfGeneration(gen1)), qt.IsNil)
+	qtc.Check(cache.PutIf("k", []byte("c"), squirrel.IfGeneration(gen1)), qt.ErrorIs, squirrel.ErrPreconditionFailed)
+	value, err := cache.ReadAll("k", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(value), qt.Equals, "b")
+	info, err = cache.Stat("k")
+	qtc.Assert(err, qt.IsNil)
+	gen2 := info.Generation
+	qtc.Check(gen2 > gen1, qt.IsTrue)
+
+	qtc.Check(cache.DeleteIf("k", squirrel.IfGeneration(gen1)), qt.ErrorIs, squirrel.ErrPreconditionFailed)
+	qtc.Assert(cache.DeleteIf("k", squirrel.IfGeneration(gen2)), qt.IsNil)
+	qtc.Check(cache.DeleteIf("k", squirrel.IfPresent()), qt.ErrorIs, squirrel.ErrPreconditionFailed)
+	_, err = cache.CreateIf("k", squirrel.CreateOpts{Length: 1}, squirrel.IfPresent())
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrPreconditionFailed)
+
+	// A recreated key never gets an old generation back.
+	pb, err := cache.CreateIf("k", squirrel.CreateOpts{Length: 1}, squirrel.IfAbsent())
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(pb.Close(), qt.IsNil)
+	info, err = cache.Stat("k")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(info.Generation > gen2, qt.IsTrue)
+}
+
+func TestCounters(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	var eg errgroup.Group
+	for range [20]struct{}{} {
+		eg.Go(func() error {
+			_, err := cache.Incr("hits", 2)
+			return err
+		})
+	}
+	qtc.Assert(eg.Wait(), qt.IsNil)
+	value, err := cache.Decr("hits", 5)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.Equals, int64(35))
+	b, err := cache.ReadAll("hits", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "35")
+	qtc.Assert(cache.SetTag("hits", "owner", "me"), qt.IsNil)
+	before, err := cache.Stat("hits")
+	qtc.Assert(err, qt.IsNil)
+	// The value gets longer, but it's still the same key.
+	_, err = cache.Incr("hits", 100)
+	qtc.Assert(err, qt.IsNil)
+	after, err := cache.Stat("hits")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(after.Length, qt.Equals, int64(3))
+	qtc.Check(after.CreateTime.Equal(before.CreateTime), qt.IsTrue)
+	qtc.Check(after.Generation > before.Generation, qt.IsTrue)
+	tags, err := cache.Tags("hits")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(tags, qt.DeepEquals, map[string]any{"owner": "me"})
+
+	qtc.Assert(cache.Put("text", []byte("nope")), qt.IsNil)
+	_, err = cache.Incr("text", 1)
+	qtc.Check(err, qt.ErrorMatches, `value of "text" is not a counter.*`)
+	// Negating this would overflow.
+	_, err = cache.Decr("hits", math.MinInt64)
+	qtc.Check(err, qt.ErrorMatches, `counter "hits" overflows`)
+
+	opts := squirrel.IncrOpts{TTL: 5 * time.Millisecond}
+	value, err = cache.IncrWithOpts("window", 1, opts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.Equals, int64(1))
+	value, err = cache.IncrWithOpts("window", 1, opts)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.Equals, int64(2))
+	qtc.Assert(cache.SetTag("window", "owner", "me"), qt.IsNil)
+	time.Sleep(10 * time.Millisecond)
+	// Expired counters are missing to every read.
+	_, err = cache.GetCounter("window")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	_, err = cache.ReadAll("window", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	_, err = cache.Stat("window")
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+	qtc.Assert(cache.IterKeys("window", func(ki squirrel.KeyInfo) bool {
+		qtc.Errorf("iterated expired counter %q", ki.Key)
+		return true
+	}), qt.IsNil)
+	// Long enough that it doesn't expire again before we look.
+	value, err = cache.IncrWithOpts("window", 1, squirrel.IncrOpts{TTL: time.Hour})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.Equals, int64(1))
+	value, err = cache.GetCounter("window")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(value, qt.Equals, int64(1))
+	// Only the expiry was reset.
+	tags, err = cache.Tags("window")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(tags, qt.DeepEquals, map[string]any{"owner": "me"})
+}
+
+func TestBackup(t *testing.T) {
+	qtc := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	opts.SetJournalMode = "wal"
+	cache := squirrel.TestingNewCache(qtc, opts)
+	value := bytes.Repeat([]byte("squirrel"), 10000)
+	qtc.Assert(cache.Put("before", value), qt.IsNil)
+	// Writes through another connection during the backup don't appear in it.
+	other := squirrel.TestingNewCache(qtc, opts)
+	destPath := squirrel.TestingTempCachePath(t)
+	steps := 0
+	err := cache.BackupWithOpts(context.Background(), destPath, squirrel.BackupOpts{
+		StepPages: 1,
+		Progress: func(remaining, total int) {
+			if steps == 0 {
+				qtc.Check(other.Put("during", nil), qt.IsNil)
+			}
+			steps++
+			qtc.Check(remaining < total, qt.IsTrue)
+		},
+	})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(steps > 1, qt.IsTrue)
+	_, err = cache.ReadAll("during", nil)
+	qtc.Check(err, qt.IsNil)
+	backupOpts := squirrel.TestingDefaultCacheOpts(qtc)
+	backupOpts.Path = destPath
+	backup := squirrel.TestingNewCache(qtc, backupOpts)
+	b, err := backup.ReadAll("before", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	_, err = backup.ReadAll("during", nil)
+	qtc.Check(err, qt.ErrorIs, squirrel.ErrNotFound)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	qtc.Check(cache.Backup(ctx, destPath), qt.ErrorIs, context.Canceled)
+
+	// The temporary file goes next to a relative destination too, not in TMPDIR.
+	chdirTemp(qtc)
+	t.Setenv("TMPDIR", "nonexistent")
+	qtc.Assert(cache.Backup(context.Background(), "backup.db"), qt.IsNil)
+	_, err = os.Stat("backup.db")
+	qtc.Check(err, qt.IsNil)
+}
+
+// Changes to a new temporary directory until the test is done.
+func chdirTemp(c *qt.C) {
+	wd, err := os.Getwd()
+	c.Assert(err, qt.IsNil)
+	c.Assert(os.Chdir(c.TempDir()), qt.IsNil)
+	c.Cleanup(func() {
+		c.Check(os.Chdir(wd), qt.IsNil)
+	})
+}
+
+func TestCompact(t *testing.T) {
+	qtc := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	opts.SetJournalMode = "wal"
+	cache := squirrel.TestingNewCache(qtc, opts)
+	value := bytes.Repeat([]byte("squirrel"), 1000)
+	for i := range [100]struct{}{} {
+		qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil)
+	}
+	for i := range [99]struct{}{} {
+		qtc.Assert(cache.Delete(fmt.Sprint(i)), qt.IsNil)
+	}
+	// Use the cache while it's being compacted.
+	var eg errgroup.Group
+	for range [10]struct{}{} {
+		eg.Go(func() error {
+			_, err := cache.ReadAll("99", nil)
+			return err
+		})
+	}
+	reclaimed, err := cache.Compact(context.Background())
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(eg.Wait(), qt.IsNil)
+	qtc.Check(reclaimed > int64(len(value))*90, qt.IsTrue, qt.Commentf("reclaimed %v", reclaimed))
+	b, err := cache.ReadAll("99", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+	qtc.Assert(cache.Put("after", nil), qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cache.Compact(ctx)
+	qtc.Check(sqlite.IsResultCode(err, sqlite.ResultCodeInterrupt), qt.IsTrue, qt.Commentf("%v", err))
+	_, err = cache.ReadAll("after", nil)
+	qtc.Check(err, qt.IsNil)
+}
+
+func TestCompactRelativePath(t *testing.T) {
+	qtc := qt.New(t)
+	chdirTemp(qtc)
+	// The compacted copy has to be renamed over the database, so it can't go in TMPDIR.
+	t.Setenv("TMPDIR", "nonexistent")
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	opts.Path = "cache.db"
+	cache := squirrel.TestingNewCache(qtc, opts)
+	value := bytes.Repeat([]byte("squirrel"), 1000)
+	for i := range [10]struct{}{} {
+		qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil)
+	}
+	for i := range [9]struct{}{} {
+		qtc.Assert(cache.Delete(fmt.Sprint(i)), qt.IsNil)
+	}
+	reclaimed, err := cache.Compact(context.Background())
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(reclaimed > 0, qt.IsTrue)
+	b, err := cache.ReadAll("9", nil)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.DeepEquals, value)
+}
+
+func TestIncrementalVacuum(t *testing.T) {
+	qtc := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	opts.SetAutoVacuum = g.Some("incremental")
+	opts.RequireAutoVacuum = g.Some[any](2)
+	cache := squirrel.TestingNewCache(qtc, opts)
+	value := bytes.Repeat([]byte("squirrel"), 1000)
+	putAndDelete := func(cache *squirrel.Cache) squirrel.Usage {
+		for i := range [50]struct{}{} {
+			qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil)
+		}
+		for i := range [50]struct{}{} {
+			qtc.Assert(cache.Delete(fmt.Sprint(i)), qt.IsNil)
+		}
+		usage, err := cache.Usage()
+		qtc.Assert(err, qt.IsNil)
+		return usage
+	}
+	// Nothing vacuums without a policy.
+	usage := putAndDelete(cache)
+	qtc.Assert(usage.FreelistCount > 50, qt.IsTrue)
+	reclaimed, err := cache.ReclaimSpace(context.Background(), 10)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(reclaimed, qt.Equals, int64(10))
+	reclaimed, err = cache.ReclaimSpace(context.Background(), 0)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(reclaimed, qt.Equals, usage.FreelistCount-10)
+	after, err := cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(after.FreelistCount, qt.Equals, int64(0))
+	qtc.Check(after.PageCount, qt.Equals, usage.PageCount-usage.FreelistCount)
+
+	opts.IncrementalVacuum = squirrel.IncrementalVacuumOpts{FreelistThreshold: 4, MaxPages: 1 << 20}
+	cache = squirrel.TestingNewCache(qtc, opts)
+	usage = putAndDelete(cache)
+	qtc.Check(usage.FreelistCount <= 4, qt.IsTrue, qt.Commentf("%v", usage.FreelistCount))
+}
+
+func TestFileSizeCapacity(t *testing.T) {
+	qtc := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	opts.SetJournalMode = "wal"
+	opts.SetAutoVacuum = g.Some("incremental")
+	opts.CapacityMode = squirrel.CapacityFileSize
+	opts.Capacity = 256 << 10
+	cache := squirrel.TestingNewCache(qtc, opts)
+	value := bytes.Repeat([]byte("squirrel"), 1000)
+	// Rewriting the same keys grows the WAL and freelist, but not the live data.
+	for range [20]struct{}{} {
+		for i := range [10]struct{}{} {
+			qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil)
+		}
+	}
+	for i := range [10]struct{}{} {
+		_, err := cache.ReadAll(fmt.Sprint(i), nil)
+		qtc.Check(err, qt.IsNil)
+	}
+	usage, err := cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(usage.BytesUsed, qt.Equals, usage.PageCount*usage.PageSize)
+	qtc.Check(usage.BytesUsed+usage.JournalBytes <= opts.Capacity, qt.IsTrue, qt.Commentf("%+v", usage))
+}
+
+func TestFileSizeCapacityDistinctKeys(t *testing.T) {
+	for _, autoVacuum := range []string{"incremental", "none"} {
+		t.Run(autoVacuum, func(t *testing.T) {
+			qtc := qt.New(t)
+			opts := squirrel.TestingDefaultCacheOpts(qtc)
+			opts.SetJournalMode = "wal"
+			opts.SetAutoVacuum = g.Some(autoVacuum)
+			opts.CapacityMode = squirrel.CapacityFileSize
+			opts.Capacity = 256 << 10
+			cache := squirrel.TestingNewCache(qtc, opts)
+			value := bytes.Repeat([]byte("squirrel"), 2500)
+			// Each key evicts older ones, whose pages are then free rather than gone.
+			for i := range [100]struct{}{} {
+				qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil, qt.Commentf("put %v", i))
+			}
+			_, err := cache.ReadAll("99", nil)
+			qtc.Check(err, qt.IsNil)
+			usage, err := cache.Usage()
+			qtc.Assert(err, qt.IsNil)
+			qtc.Check(usage.Keys > 1, qt.IsTrue, qt.Commentf("%+v", usage))
+			// Free pages that can't be returned are reused, so the file doesn't keep growing.
+			qtc.Check(usage.PageCount*usage.PageSize <= opts.Capacity+int64(len(value))*2, qt.IsTrue, qt.Commentf("%+v", usage))
+			if autoVacuum == "incremental" {
+				qtc.Check(usage.BytesUsed+usage.JournalBytes <= opts.Capacity, qt.IsTrue, qt.Commentf("%+v", usage))
+			}
+		})
+	}
+}
+
+func TestTrimWatermarks(t *testing.T) {
+	qtc := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	opts.Capacity = 256 << 10
+	opts.TrimWatermarks = squirrel.TrimWatermarks{High: 1, Low: 0.5}
+	cache := squirrel.TestingNewCache(qtc, opts)
+	value := bytes.Repeat([]byte("squirrel"), 1000)
+	var prev squirrel.Usage
+	trims := 0
+	for i := range [100]struct{}{} {
+		qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil)
+		usage, err := cache.Usage()
+		qtc.Assert(err, qt.IsNil)
+		qtc.Assert(usage.BytesUsed <= opts.Capacity, qt.IsTrue)
+		if usage.Keys <= prev.Keys {
+			trims++
+			// Evicting stopped at the low watermark, not just under the capacity.
+			qtc.Check(usage.BytesUsed <= opts.Capacity/2, qt.IsTrue, qt.Commentf("%+v", usage))
+		}
+		prev = usage
+	}
+	// Each trim made room for many more keys.
+	qtc.Check(trims > 0, qt.IsTrue)
+	qtc.Check(trims < 10, qt.IsTrue, qt.Commentf("%v", trims))
+}
+
+func TestBackgroundTrim(t *testing.T) {
+	qtc := qt.New(t)
+	opts := squirrel.TestingDefaultCacheOpts(qtc)
+	opts.Capacity = 256 << 10
+	opts.BackgroundTrim = squirrel.BackgroundTrimOpts{Enabled: true, MaxOvershoot: 0.5}
+	cache := squirrel.TestingNewCache(qtc, opts)
+	value := bytes.Repeat([]byte("squirrel"), 1000)
+	hardLimit := opts.Capacity * 3 / 2
+	for i := range [100]struct{}{} {
+		qtc.Assert(cache.Put(fmt.Sprint(i), value), qt.IsNil)
+		usage, err := cache.Usage()
+		qtc.Assert(err, qt.IsNil)
+		qtc.Assert(usage.BytesUsed <= hardLimit, qt.IsTrue, qt.Commentf("%+v", usage))
+	}
+	// The trimmer catches up once writes stop.
+	deadline := time.Now().Add(10 * time.Second)
+	var usage squirrel.Usage
+	for {
+		var err error
+		usage, err = cache.Usage()
+		qtc.Assert(err, qt.IsNil)
+		if usage.BytesUsed <= opts.Capacity || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	qtc.Check(usage.BytesUsed <= opts.Capacity, qt.IsTrue, qt.Commentf("%+v", usage))
+}
+
+func TestTrimManySmallKeys(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	var items []squirrel.KeyValue
+	for i := range [5000]struct{}{} {
+		items = append(items, squirrel.KeyValue{Key: fmt.Sprint(i), Value: make([]byte, 100)})
+	}
+	errs, err := cache.PutMany(items)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(errors.Join(errs...), qt.IsNil)
+	before, err := cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	target := before.BytesUsed - 256<<10
+	evicted, err := cache.TrimTo(target)
+	qtc.Assert(err, qt.IsNil)
+	after, err := cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(after.BytesUsed <= target, qt.IsTrue)
+	qtc.Check(after.Keys, qt.Equals, before.Keys-int64(evicted))
+	qtc.Check(evicted > 0 && evicted < len(items), qt.IsTrue, qt.Commentf("%v", evicted))
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package squirrel
+
+import (
+	"syscall"
+)
+
+// Returns the size and the space available to unprivileged users of the filesystem holding path.
+func statfs(path string) (total, avail int64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return
+	}
+	// Block counts are in fragment size units.
+	blockSize := int64(st.Frsize)
+	if blockSize == 0 {
+		blockSize = int64(st.Bsize)
+	}
+	total = int64(st.Blocks) * blockSize
+	avail = int64(st.Bavail) * blockSize
+	return
+}
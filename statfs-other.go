@@ -0,0 +1,12 @@
+//go:build !linux
+
+package squirrel
+
+import (
+	"errors"
+)
+
+func statfs(path string) (total, avail int64, err error) {
+	err = errors.New("not supported on this platform")
+	return
+}
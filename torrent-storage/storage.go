@@ -0,0 +1,79 @@
+// Package torrentStorage implements anacrolix/torrent storage on top of a squirrel Cache. It's a
+// separate module so squirrel itself doesn't depend on anacrolix/torrent.
+package torrentStorage
+
+import (
+	"errors"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+
+	"github.com/anacrolix/squirrel"
+)
+
+// The tag recording whether a piece's data is known to match its hash. Tags are deleted with their
+// key, so eviction also forgets completion.
+const completeTag = "complete"
+
+type client struct {
+	cache    *squirrel.Cache
+	capacity func() (int64, bool)
+}
+
+// Returns a storage.ClientImpl that stores pieces in cache, keyed by piece hash. Torrents sharing
+// piece data will share keys. The Cache is not closed by the client.
+func NewClient(cache *squirrel.Cache) storage.ClientImpl {
+	return &client{
+		cache:    cache,
+		capacity: cache.GetCapacity,
+	}
+}
+
+func (c *client) OpenTorrent(*metainfo.Info, metainfo.Hash) (storage.TorrentImpl, error) {
+	t := torrent{c.cache}
+	return storage.TorrentImpl{
+		Piece: t.Piece,
+		Close: t.Close,
+		// All torrents share the capacity of the Cache.
+		Capacity: &c.capacity,
+	}, nil
+}
+
+type torrent struct {
+	cache *squirrel.Cache
+}
+
+func (t torrent) Piece(p metainfo.Piece) storage.PieceImpl {
+	return piece{t.cache.BlobWithLength(p.Hash().HexString(), p.Length())}
+}
+
+func (t torrent) Close() error {
+	return nil
+}
+
+type piece struct {
+	squirrel.Blob
+}
+
+func (p piece) MarkComplete() error {
+	return p.SetTag(completeTag, true)
+}
+
+func (p piece) MarkNotComplete() error {
+	err := p.SetTag(completeTag, false)
+	if errors.Is(err, squirrel.ErrNotFound) {
+		// There's no data to be wrong about.
+		err = nil
+	}
+	return err
+}
+
+func (p piece) Completion() (ret storage.Completion) {
+	// If the key doesn't exist, including if it was evicted, there's no tag and the piece is
+	// definitely incomplete.
+	ret.Err = p.GetTag(completeTag, func(stmt squirrel.SqliteStmt) {
+		ret.Complete = stmt.ColumnInt(0) != 0
+	})
+	ret.Ok = ret.Err == nil
+	return
+}
@@ -0,0 +1,70 @@
+package torrentStorage
+
+import (
+	"crypto/sha1"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+
+	"github.com/anacrolix/squirrel"
+)
+
+func TestPieceCompletionAndEviction(t *testing.T) {
+	qtc := qt.New(t)
+	cache := squirrel.TestingNewCache(qtc, squirrel.TestingDefaultCacheOpts(qtc))
+	const pieceLength = 1 << 16
+	pieces := [][]byte{make([]byte, pieceLength), make([]byte, pieceLength)}
+	info := metainfo.Info{
+		PieceLength: pieceLength,
+		Length:      2 * pieceLength,
+	}
+	for i, p := range pieces {
+		p[0] = byte(i + 1)
+		h := sha1.Sum(p)
+		info.Pieces = append(info.Pieces, h[:]...)
+	}
+	ti, err := NewClient(cache).OpenTorrent(&info, metainfo.Hash{})
+	qtc.Assert(err, qt.IsNil)
+	defer ti.Close()
+	capacity, capped := (*ti.Capacity)()
+	qtc.Check(capped, qt.IsFalse)
+	qtc.Check(capacity, qt.Equals, int64(0))
+
+	p0 := ti.Piece(info.Piece(0))
+	qtc.Check(p0.Completion(), qt.Equals, storage.Completion{Ok: true})
+	qtc.Assert(p0.MarkNotComplete(), qt.IsNil)
+	n, err := p0.WriteAt(pieces[0], 0)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(n, qt.Equals, pieceLength)
+	qtc.Check(p0.Completion(), qt.Equals, storage.Completion{Ok: true})
+	qtc.Assert(p0.MarkComplete(), qt.IsNil)
+	qtc.Check(p0.Completion(), qt.Equals, storage.Completion{Complete: true, Ok: true})
+	qtc.Assert(p0.MarkNotComplete(), qt.IsNil)
+	qtc.Check(p0.Completion(), qt.Equals, storage.Completion{Ok: true})
+	qtc.Assert(p0.MarkComplete(), qt.IsNil)
+
+	// Writing the second piece over capacity evicts the least recently used first piece.
+	usage, err := cache.Usage()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(cache.SetCapacity(usage.BytesUsed+pieceLength/2), qt.IsNil)
+	capacity, capped = (*ti.Capacity)()
+	qtc.Check(capped, qt.IsTrue)
+	qtc.Check(capacity, qt.Equals, usage.BytesUsed+pieceLength/2)
+	// Make sure the new piece is more recently used, since last used times are in milliseconds.
+	time.Sleep(2 * time.Millisecond)
+	p1 := ti.Piece(info.Piece(1))
+	_, err = p1.WriteAt(pieces[1], 0)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(p1.MarkComplete(), qt.IsNil)
+	qtc.Check(p1.Completion(), qt.Equals, storage.Completion{Complete: true, Ok: true})
+	qtc.Check(p0.Completion(), qt.Equals, storage.Completion{Ok: true})
+	b := make([]byte, pieceLength)
+	n, err = p1.ReadAt(b, 0)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(n, qt.Equals, pieceLength)
+	qtc.Check(b, qt.DeepEquals, pieces[1])
+}
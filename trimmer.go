@@ -0,0 +1,86 @@
+package squirrel
+
+import (
+	"github.com/anacrolix/log"
+)
+
+const defaultBackgroundTrimMaxOvershoot = 0.1
+
+// Trimming in a background goroutine, rather than before committing every transaction. Read
+// transactions then don't trim at all, and write transactions only check whether trimming is needed.
+type BackgroundTrimOpts struct {
+	Enabled bool
+	// How far usage can go past the high watermark, as a fraction of the capacity, before write
+	// transactions trim synchronously anyway. This bounds the overshoot if the background trimmer
+	// falls behind. Non-positive uses a default.
+	MaxOvershoot float64
+}
+
+func (me BackgroundTrimOpts) maxOvershoot() float64 {
+	if me.MaxOvershoot <= 0 {
+		return defaultBackgroundTrimMaxOvershoot
+	}
+	return me.MaxOvershoot
+}
+
+// Trims as part of a transaction. With background trimming, it's only done past the hard limit, and
+// otherwise the trimmer is asked to do it.
+func (conn conn) trimForTx(tx *Tx, eachKey func(keyId rowid)) (err error) {
+	if conn.trimRequests == nil {
+		return conn.trimToCapacity(tx.write, eachKey)
+	}
+	if !tx.write {
+		return
+	}
+	capacity, _, err := conn.effectiveCapacity()
+	if err != nil || !capacity.Ok {
+		return
+	}
+	high, _ := conn.trimWatermarks.marks(capacity.Value)
+	bytesUsed, err := conn.bytesUsed()
+	if err != nil || bytesUsed <= high {
+		return
+	}
+	hardLimit := high + int64(conn.backgroundTrim.maxOvershoot()*float64(capacity.Value))
+	if bytesUsed > hardLimit {
+		return conn.trimToCapacity(true, eachKey)
+	}
+	select {
+	case conn.trimRequests <- struct{}{}:
+	default:
+		// The trimmer has already been asked.
+	}
+	return
+}
+
+// Trims whenever transactions report the cache is over capacity, until the Cache is closed.
+func (c *Cache) runBackgroundTrimmer() {
+	defer close(c.trimmerDone)
+	for {
+		select {
+		case <-c.trimRequests:
+		case <-c.stopTrimmer:
+			return
+		}
+		err := c.TxImmediate(func(tx *Tx) error {
+			return tx.conn.trimToCapacity(true, nil)
+		})
+		if err == errNoKeysToEvict {
+			err = nil
+		}
+		if err != nil {
+			c.opts.Logger.Levelf(log.Warning, "background trim: %v", err)
+		}
+	}
+}
+
+// Stops the background trimmer, if it's running, and waits for it to finish.
+func (c *Cache) stopBackgroundTrimmer() {
+	if c.trimRequests == nil {
+		return
+	}
+	c.stopTrimmerOnce.Do(func() {
+		close(c.stopTrimmer)
+	})
+	<-c.trimmerDone
+}
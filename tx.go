@@ -60,8 +60,35 @@ func (tx *Tx) Put(name string, b []byte) (err error) {
 	if err != nil {
 		return
 	}
-	_, err = pb.WriteAt(b, 0)
+	// Writing at the end of a value returns EOF, even for empty writes.
+	if len(b) != 0 {
+		_, err = pb.WriteAt(b, 0)
+	}
+	err = errors.Join(err, pb.Close())
+	return
+}
+
+// Writes length bytes from r to name, replacing any existing value. It's an error if r ends early.
+func (tx *Tx) PutReader(name string, r io.Reader, length int64) (err error) {
+	_, err = tx.putReader(name, r, length)
+	return
+}
+
+func (tx *Tx) putReader(name string, r io.Reader, length int64) (keyId rowid, err error) {
+	err = tx.Delete(name)
+	if err != nil && err != ErrNotFound {
+		return
+	}
+	pb, err := tx.Create(name, CreateOpts{length})
+	if err != nil {
+		return
+	}
+	keyId = pb.valueId
+	n, err := io.Copy(io.NewOffsetWriter(pb, 0), io.LimitReader(r, length))
 	err = errors.Join(err, pb.Close())
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
 	return
 }
 
@@ -99,7 +126,14 @@ func (tx *Tx) readFull(valueId rowid, b []byte) (n int, err error) {
 				err = io.EOF
 				return
 			}
-			n1, err := blob.ReadAt(b, nextOff-offset)
+			b1 := b
+			if int64(len(b1)) > blob.Size()-(nextOff-offset) {
+				b1 = b1[:blob.Size()-(nextOff-offset)]
+			}
+			n1, err := blob.ReadAt(b1, nextOff-offset)
+			if n1 == len(b1) && err == io.EOF {
+				err = nil
+			}
 			n += n1
 			b = b[n1:]
 			nextOff += int64(n1)
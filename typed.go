@@ -0,0 +1,138 @@
+package squirrel
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// Converts between values and their stored bytes for Typed.
+type Codec[V any] interface {
+	Encode(V) ([]byte, error)
+	Decode([]byte) (V, error)
+}
+
+// A Cache with keys of type K and values of type V. Keys are converted to strings with EncodeKey,
+// which must be injective, and values are stored with Codec.
+type Typed[K, V any] struct {
+	Cache     *Cache
+	EncodeKey func(K) string
+	Codec     Codec[V]
+}
+
+func NewTyped[K, V any](cache *Cache, encodeKey func(K) string, codec Codec[V]) Typed[K, V] {
+	return Typed[K, V]{
+		Cache:     cache,
+		EncodeKey: encodeKey,
+		Codec:     codec,
+	}
+}
+
+// A key encoder for string keys, which are used as is.
+func StringKey[K ~string](k K) string {
+	return string(k)
+}
+
+// Returns ErrNotFound if there's no value for k.
+func (me Typed[K, V]) Get(k K) (v V, err error) {
+	b, err := me.Cache.ReadAll(me.EncodeKey(k), nil)
+	if err != nil {
+		return
+	}
+	return me.Codec.Decode(b)
+}
+
+func (me Typed[K, V]) Put(k K, v V) error {
+	b, err := me.Codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return me.Cache.Put(me.EncodeKey(k), b)
+}
+
+func (me Typed[K, V]) Delete(k K) error {
+	return me.Cache.Delete(me.EncodeKey(k))
+}
+
+// See Cache.GetOrLoad.
+func (me Typed[K, V]) GetOrLoad(ctx context.Context, k K, load func(ctx context.Context) (V, error)) (V, error) {
+	return me.GetOrLoadWithOpts(ctx, k, load, LoadOpts{})
+}
+
+// See Cache.GetOrLoadWithOpts.
+func (me Typed[K, V]) GetOrLoadWithOpts(
+	ctx context.Context, k K, load func(ctx context.Context) (V, error), opts LoadOpts,
+) (v V, err error) {
+	b, err := me.Cache.GetOrLoadWithOpts(ctx, me.EncodeKey(k), func(ctx context.Context) (io.ReadCloser, int64, error) {
+		v, err := load(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		b, err := me.Codec.Encode(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+	}, opts)
+	if err != nil {
+		return
+	}
+	return me.Codec.Decode(b)
+}
+
+// Stores values with encoding/gob.
+type GobCodec[V any] struct{}
+
+func (GobCodec[V]) Encode(v V) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[V]) Decode(b []byte) (v V, err error) {
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return
+}
+
+// Stores values with encoding/json.
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[V]) Decode(b []byte) (v V, err error) {
+	err = json.Unmarshal(b, &v)
+	return
+}
+
+// Stores byte slices as they are.
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (BytesCodec) Decode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+// Stores values using their encoding.BinaryMarshaler and encoding.BinaryUnmarshaler methods. P is
+// the pointer type of V, like BinaryCodec[time.Time, *time.Time].
+type BinaryCodec[V any, P interface {
+	*V
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+func (BinaryCodec[V, P]) Encode(v V) ([]byte, error) {
+	return P(&v).MarshalBinary()
+}
+
+func (BinaryCodec[V, P]) Decode(b []byte) (v V, err error) {
+	err = P(&v).UnmarshalBinary(b)
+	return
+}
@@ -3,8 +3,9 @@ package squirrel
 type rowid = int64
 
 type keyCols struct {
-	id     rowid
-	length int64
+	id      rowid
+	length  int64
+	expired bool
 }
 
 // sqlite3 mentions this might be limited to 2<<31-1. By default it's actually limited to 1e9. The
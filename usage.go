@@ -0,0 +1,60 @@
+package squirrel
+
+import (
+	sqlite "github.com/go-llsqlite/adapter"
+)
+
+// A snapshot of the space used by a Cache.
+type Usage struct {
+	// The value compared against the capacity when trimming.
+	BytesUsed     int64
+	PageSize      int64
+	PageCount     int64
+	FreelistCount int64
+	Keys          int64
+	// Sum of the lengths of all values.
+	ValueBytes int64
+	// Size of the WAL or rollback journal files.
+	JournalBytes int64
+}
+
+func (conn conn) usage() (ret Usage, err error) {
+	ret.PageCount, err = conn.execPragmaReturningInt64("page_count")
+	if err != nil {
+		return
+	}
+	ret.PageSize, err = conn.execPragmaReturningInt64("page_size")
+	if err != nil {
+		return
+	}
+	ret.FreelistCount, err = conn.execPragmaReturningInt64("freelist_count")
+	if err != nil {
+		return
+	}
+	ret.JournalBytes, err = conn.journalBytes()
+	if err != nil {
+		return
+	}
+	ret.BytesUsed, err = conn.bytesUsed()
+	if err != nil {
+		return
+	}
+	err = conn.sqliteQueryMustOneRow(
+		`select count(*), coalesce(sum(length), 0) from keys`,
+		func(stmt *sqlite.Stmt) error {
+			ret.Keys = stmt.ColumnInt64(0)
+			ret.ValueBytes = stmt.ColumnInt64(1)
+			return nil
+		},
+	)
+	return
+}
+
+// Returns the space used by the Cache, within a single read transaction.
+func (c *Cache) Usage() (ret Usage, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		ret, err = tx.conn.usage()
+		return
+	})
+	return
+}
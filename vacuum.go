@@ -0,0 +1,88 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+)
+
+const defaultIncrementalVacuumPages = 1024
+
+// When to run pragma incremental_vacuum at the end of write transactions, so the file shrinks as
+// keys are removed. This does nothing unless the database has auto_vacuum=incremental, see
+// InitDbOpts.SetAutoVacuum. The zero value never vacuums.
+type IncrementalVacuumOpts struct {
+	// Vacuum after trimming to capacity evicts keys.
+	AfterTrim bool
+	// Vacuum when the freelist has more than this many pages. Zero disables this.
+	FreelistThreshold int64
+	// Most pages to free per transaction, to bound how long writers are held up. Non-positive uses
+	// a default.
+	MaxPages int64
+}
+
+func (opts IncrementalVacuumOpts) maxPages() int64 {
+	if opts.MaxPages <= 0 {
+		return defaultIncrementalVacuumPages
+	}
+	return opts.MaxPages
+}
+
+// Runs incremental vacuum per the conn's policy. trimmed is whether the transaction evicted keys.
+func (conn conn) maybeIncrementalVacuum(trimmed bool) (err error) {
+	opts := conn.incrementalVacuum
+	if !(trimmed && opts.AfterTrim) {
+		if opts.FreelistThreshold <= 0 {
+			return
+		}
+		var freelistCount int64
+		freelistCount, err = conn.execPragmaReturningInt64("freelist_count")
+		if err != nil || freelistCount <= opts.FreelistThreshold {
+			return
+		}
+	}
+	return conn.incrementalVacuumPages(opts.maxPages())
+}
+
+func (conn conn) incrementalVacuumPages(pages int64) error {
+	// Pragmas can't take parameters.
+	return conn.sqliteExec(fmt.Sprintf("pragma incremental_vacuum(%d)", pages))
+}
+
+// Returns up to maxPages free pages to the filesystem, or all of them if maxPages isn't positive.
+// This works in bounded steps, each in its own transaction, so other writers get a turn, and stops
+// between steps if ctx is done. Requires auto_vacuum=incremental.
+func (c *Cache) ReclaimSpace(ctx context.Context, maxPages int64) (reclaimed int64, err error) {
+	stepPages := c.opts.IncrementalVacuum.maxPages()
+	for maxPages <= 0 || reclaimed < maxPages {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		pages := stepPages
+		if maxPages > 0 && maxPages-reclaimed < pages {
+			pages = maxPages - reclaimed
+		}
+		var freed int64
+		err = c.TxImmediate(func(tx *Tx) (err error) {
+			before, err := tx.conn.execPragmaReturningInt64("freelist_count")
+			if err != nil {
+				return
+			}
+			err = tx.conn.incrementalVacuumPages(pages)
+			if err != nil {
+				return
+			}
+			after, err := tx.conn.execPragmaReturningInt64("freelist_count")
+			freed = before - after
+			return
+		})
+		if err != nil {
+			return
+		}
+		reclaimed += freed
+		if freed < pages {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,118 @@
+package squirrel
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"time"
+
+	g "github.com/anacrolix/generics"
+)
+
+const defaultVolumeRefreshInterval = 10 * time.Second
+
+// Limits the cache relative to the filesystem holding it, so it gives way when other users of the
+// filesystem grow. Trimming uses the smallest of these and the capacity stored in the database.
+// This is only supported on Linux, and pairs best with CapacityFileSize, since that counts what's
+// actually on disk. If a volume limit can't be met even with every key evicted, that's logged rather
+// than failing transactions.
+type VolumeCapacity struct {
+	// Use at most this fraction of the filesystem's size. Zero disables this.
+	MaxFraction float64
+	// Leave at least this many bytes free on the filesystem. Zero disables this.
+	MinFree int64
+	// How long a limit is used before checking the filesystem again. Limits are checked when
+	// trimming. Non-positive uses a default.
+	RefreshInterval time.Duration
+}
+
+func (me VolumeCapacity) enabled() bool {
+	return me.MaxFraction > 0 || me.MinFree > 0
+}
+
+func (me VolumeCapacity) refreshInterval() time.Duration {
+	if me.RefreshInterval <= 0 {
+		return defaultVolumeRefreshInterval
+	}
+	return me.RefreshInterval
+}
+
+// A limit from VolumeCapacity, and when it needs recalculating.
+type volumeLimit struct {
+	limit   int64
+	expires time.Time
+}
+
+// Returns the limit from the conn's VolumeCapacity, recalculating it if it's stale.
+func (conn conn) getVolumeLimit() (limit g.Option[int64], err error) {
+	opts := conn.volumeCapacity
+	if !opts.enabled() || conn.path == "" {
+		return
+	}
+	now := time.Now()
+	if now.Before(conn.volumeLimit.expires) {
+		limit.Set(conn.volumeLimit.limit)
+		return
+	}
+	// The directory exists even before the database file is created.
+	total, avail, err := statfs(filepath.Dir(conn.path))
+	if err != nil {
+		err = fmt.Errorf("getting filesystem stats for volume capacity: %w", err)
+		return
+	}
+	var value int64 = math.MaxInt64
+	if opts.MaxFraction > 0 {
+		value = int64(opts.MaxFraction * float64(total))
+	}
+	if opts.MinFree > 0 {
+		// The cache can grow into the free space beyond the minimum, or has to shrink by as much as
+		// it's short.
+		var used int64
+		used, err = conn.bytesUsed()
+		if err != nil {
+			return
+		}
+		if minFreeLimit := used + avail - opts.MinFree; minFreeLimit < value {
+			value = minFreeLimit
+		}
+	}
+	if value < 0 {
+		value = 0
+	}
+	conn.volumeLimit = volumeLimit{
+		limit:   value,
+		expires: now.Add(opts.refreshInterval()),
+	}
+	limit.Set(value)
+	return
+}
+
+// Returns the capacity used for trimming, which is the smaller of the stored capacity and any
+// volume limit. volumeBound is true if it's the volume limit.
+func (conn conn) effectiveCapacity() (capacity g.Option[int64], volumeBound bool, err error) {
+	capacity, err = conn.getCapacity()
+	if err != nil {
+		return
+	}
+	volume, err := conn.getVolumeLimit()
+	if err != nil {
+		return
+	}
+	if volume.Ok && (!capacity.Ok || volume.Value < capacity.Value) {
+		capacity = volume
+		volumeBound = true
+	}
+	return
+}
+
+// Returns the capacity that trimming uses, taking NewCacheOpts.VolumeCapacity into account. Any
+// volume limit is recalculated.
+func (c *Cache) EffectiveCapacity() (capacity int64, ok bool, err error) {
+	err = c.Tx(func(tx *Tx) (err error) {
+		tx.conn.volumeLimit = volumeLimit{}
+		opt, _, err := tx.conn.effectiveCapacity()
+		capacity, ok = opt.Value, opt.Ok
+		return
+	})
+	return
+}